@@ -0,0 +1,409 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package collector exports the stats of NGINX-RTMP as Prometheus metrics.
+package collector
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/rtmpstat"
+)
+
+const (
+	namespace = "nginx_rtmp"
+
+	// Metric naming schemes
+	LegacyNaming = "legacy"
+	V2Naming     = "v2"
+
+	// Sub-collectors
+	StreamsCollector      = "streams"
+	ApplicationsCollector = "applications"
+	ServerBlocksCollector = "server_blocks"
+	ClientsCollector      = "clients"
+
+	// Scrape stages
+	stageFetch      = "fetch"
+	stageHTTPStatus = "http_status"
+	stageParse      = "parse"
+	stageExtract    = "extract"
+)
+
+// flightGrace is how long a collect past its deadline still waits for the
+// scrape in flight
+const flightGrace = 100 * time.Millisecond
+
+var scrapeStages = []string{stageFetch, stageHTTPStatus, stageParse, stageExtract}
+
+// Collector collects NGINX-RTMP stats from its fetcher
+// using the prometheus metrics package
+type Collector struct {
+	mutex                sync.RWMutex // To protect the health and the snapshot
+	flightMutex          sync.Mutex   // To protect the scrape in flight
+	flight               *flight
+	fetcher              Fetcher
+	streamNameNormalizer func(string) string
+	collectors           map[string]bool
+	maxClientsPerStream  int
+	legacyStreamLabel    bool
+	strictParsing        bool
+	naming               string
+	constLabels          prometheus.Labels
+	bandwidthUnit        float64
+	logger               log.Logger
+	timeout              time.Duration
+	pollInterval         time.Duration
+	maxStaleness         time.Duration
+	stallWindow          time.Duration
+	withoutLifecycle     bool
+	closed               atomic.Bool
+	health               health
+	snapshot             *snapshot
+	scrapeErrors         *prometheus.CounterVec
+	parseErrors          *prometheus.CounterVec
+	lifecycle            *lifecycle // nil without lifecycle tracking
+
+	exporterMetrics    map[string]*prometheus.Desc
+	serverMetrics      map[string]*prometheus.Desc
+	streamMetrics      map[string]*prometheus.Desc
+	applicationMetrics map[string]*prometheus.Desc
+	serverBlockMetrics map[string]*prometheus.Desc
+	clientMetrics      map[string]*prometheus.Desc
+}
+
+// New initializes a collector. A fetcher is required, see WithFetcher.
+func New(opts ...Option) (*Collector, error) {
+	c := &Collector{
+		streamNameNormalizer: func(name string) string { return name },
+		collectors: map[string]bool{
+			StreamsCollector:      true,
+			ApplicationsCollector: true,
+			ServerBlocksCollector: true,
+		},
+		maxClientsPerStream: 100,
+		naming:              LegacyNaming,
+		logger:              log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.fetcher == nil {
+		return nil, errors.New("no fetcher for the stats of NGINX-RTMP")
+	}
+
+	labels := streamLabels
+	if c.legacyStreamLabel {
+		labels = legacyStreamLabels
+	}
+	switch c.naming {
+	case LegacyNaming:
+		c.bandwidthUnit = 1048576 // mebibits
+	case V2Naming:
+		c.bandwidthUnit = 8 // bytes
+	}
+	c.scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "scrape_errors_total",
+		Help:        "Number of errors while scraping NGINX-RTMP, by stage",
+		ConstLabels: c.constLabels,
+	}, []string{"stage"})
+	for _, stage := range scrapeStages {
+		c.scrapeErrors.WithLabelValues(stage)
+	}
+	c.parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "parse_errors_total",
+		Help:        "Number of missing or malformed elements skipped in the stats document, by element",
+		ConstLabels: c.constLabels,
+	}, []string{"element"})
+
+	if !c.withoutLifecycle {
+		c.lifecycle = newLifecycle(c.stallWindow, c.constLabels)
+	}
+
+	c.exporterMetrics = newExporterMetrics(c.constLabels)
+	c.serverMetrics = newServerMetrics(c.naming, c.constLabels)
+	c.streamMetrics = newStreamMetrics(c.naming, labels, c.constLabels)
+	c.applicationMetrics = newApplicationMetrics(c.naming, c.constLabels)
+	c.serverBlockMetrics = newServerBlockMetrics(c.naming, c.constLabels)
+	c.clientMetrics = newClientMetrics(c.constLabels)
+	return c, nil
+}
+
+// scrapeError is an error that happened at a given stage of a scrape
+type scrapeError struct {
+	stage string
+	err   error
+}
+
+func (e *scrapeError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+// CollectContext is Collect, bounded by the deadline of ctx. A scrape that
+// times out sends the metrics collected before the deadline, and up is 0.
+// Concurrent collects share a scrape, that goes on until the latest of their
+// deadlines.
+func (c *Collector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.pollInterval > 0 {
+		c.collectSnapshot(ch)
+		return
+	}
+
+	ctx, cancel := c.scrapeContext(ctx)
+	defer cancel()
+	start := time.Now()
+	// Concurrent collects share the scrape in flight, if any
+	f := c.join(ctx)
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		// A scrape in flight with the same deadline ends with it, give it time
+		// to hand over the metrics collected until then
+		select {
+		case <-f.done:
+		case <-time.After(flightGrace):
+			level.Error(c.logger).Log("msg", "Timed out waiting for the scrape of NGINX-RTMP in flight", "err", ctx.Err())
+			c.mutex.RLock()
+			h := health{duration: time.Since(start).Seconds(), lastSuccess: c.health.lastSuccess}
+			c.mutex.RUnlock()
+			c.collectHealth(ch, h)
+			return
+		}
+	}
+	for _, m := range f.result.metrics {
+		ch <- m
+	}
+	c.collectHealth(ch, f.result.health)
+}
+
+// Close closes the keep-alive connections of the fetcher, to call when the
+// collector is no longer used. A closed collector can still collect, without
+// keeping connections alive.
+func (c *Collector) Close() {
+	c.closed.Store(true)
+	CloseIdleConnections(c.fetcher)
+}
+
+// scrapeContext bounds a scrape by the timeout of the collector, if any
+func (c *Collector) scrapeContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(parent, c.timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// observe scrapes NGINX-RTMP, counting and logging the errors
+func (c *Collector) observe(ctx context.Context, send func(prometheus.Metric)) outcome {
+	start := time.Now()
+	err := c.scrape(ctx, send)
+	result := outcome{ok: err == nil, duration: time.Since(start).Seconds()}
+	if c.closed.Load() {
+		// The connection of a scrape that ended after Close is idle now
+		CloseIdleConnections(c.fetcher)
+	}
+	if err != nil {
+		stage := stageExtract
+		var serr *scrapeError
+		if errors.As(err, &serr) {
+			stage = serr.stage
+		}
+		c.scrapeErrors.WithLabelValues(stage).Inc()
+		level.Error(c.logger).Log("msg", "Can't scrape NGINX-RTMP", "stage", stage, "err", err)
+	}
+	return result
+}
+
+// outcome of a scrape
+type outcome struct {
+	ok       bool
+	duration float64
+}
+
+// health of the scrapes, as of the last one
+type health struct {
+	up          float64
+	duration    float64
+	lastSuccess float64
+}
+
+// record updates the health of the scrapes with an outcome, and returns it
+func (c *Collector) record(result outcome) health {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.health.up = 0
+	if result.ok {
+		c.health.up = 1
+		c.health.lastSuccess = float64(time.Now().UnixNano()) / 1e9
+	}
+	c.health.duration = result.duration
+	return c.health
+}
+
+// collectHealth sends the metrics about the scrapes themselves, then the
+// counters kept from scrape to scrape
+func (c *Collector) collectHealth(ch chan<- prometheus.Metric, h health) {
+	ch <- prometheus.MustNewConstMetric(c.exporterMetrics["up"], prometheus.GaugeValue, h.up)
+	ch <- prometheus.MustNewConstMetric(c.exporterMetrics["scrapeDuration"], prometheus.GaugeValue, h.duration)
+	ch <- prometheus.MustNewConstMetric(c.exporterMetrics["lastSuccess"], prometheus.GaugeValue, h.lastSuccess)
+	c.scrapeErrors.Collect(ch)
+	c.parseErrors.Collect(ch)
+	if c.lifecycle != nil {
+		c.lifecycle.Collect(ch)
+	}
+}
+
+// bandwidth converts a bandwidth in bits per second to the unit of the naming scheme
+func (c *Collector) bandwidth(bits float64) float64 {
+	return bits / c.bandwidthUnit
+}
+
+// streamLabelValues returns the values of the labels identifying a stream.
+// The legacy label leaves the server block out, as previous versions did.
+func (c *Collector) streamLabelValues(server, application, name string) []string {
+	if !c.legacyStreamLabel {
+		return []string{server, application, name}
+	}
+	if application == "" {
+		return []string{name}
+	}
+	return []string{application + "-" + name} // dash separator between app and stream names
+}
+
+func (c *Collector) scrape(ctx context.Context, send func(prometheus.Metric)) error {
+	data, err := c.fetcher.Fetch(ctx)
+	if err != nil {
+		if errors.As(err, new(StatusError)) {
+			return &scrapeError{stageHTTPStatus, err}
+		}
+		return &scrapeError{stageFetch, err}
+	}
+	defer data.Close()
+
+	h := &metricsHandler{c: c, send: send, exported: make(map[streamKey][]string), labelled: make(map[string]bool)}
+	if c.lifecycle != nil {
+		h.seen = make(map[streamKey]rtmpstat.Stream)
+	}
+	var buffered []prometheus.Metric
+	if c.strictParsing {
+		// Nothing is sent before the whole document is known to be valid
+		h.send = func(m prometheus.Metric) { buffered = append(buffered, m) }
+	}
+
+	d := rtmpstat.Decoder{Strict: c.strictParsing}
+	err = d.Walk(&contextReader{ctx: ctx, r: data}, h)
+	for element, count := range d.FieldErrors {
+		c.parseErrors.WithLabelValues(element).Add(float64(count))
+	}
+	if err != nil {
+		var (
+			fieldErr  *rtmpstat.FieldError
+			syntaxErr *xml.SyntaxError
+		)
+		switch {
+		case errors.As(err, &fieldErr):
+			return &scrapeError{stageExtract, err}
+		case errors.As(err, &syntaxErr):
+			return &scrapeError{stageParse, err}
+		default: // reading the response body failed
+			return &scrapeError{stageFetch, err}
+		}
+	}
+	if len(d.FieldErrors) > 0 {
+		level.Debug(c.logger).Log("msg", "Skipped elements of the stats document", "count", len(d.FieldErrors))
+	}
+	// Only whole documents are compared, a stream missing from a partial one
+	// hasn't stopped
+	if c.lifecycle != nil {
+		c.lifecycle.update(h.seen, c.logger)
+	}
+
+	for _, m := range buffered {
+		send(m)
+	}
+	if c.lifecycle != nil && c.collectors[StreamsCollector] {
+		c.sendStreamStates(send, h.exported)
+	}
+	return nil
+}
+
+// Describe describes all metrics to be exported to Prometheus
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range c.exporterMetrics {
+		ch <- metric
+	}
+
+	c.scrapeErrors.Describe(ch)
+	c.parseErrors.Describe(ch)
+
+	for _, metric := range c.serverMetrics {
+		ch <- metric
+	}
+
+	if c.collectors[StreamsCollector] {
+		for _, metric := range c.streamMetrics {
+			ch <- metric
+		}
+	}
+
+	if c.collectors[ApplicationsCollector] {
+		for _, metric := range c.applicationMetrics {
+			ch <- metric
+		}
+	}
+
+	if c.lifecycle != nil {
+		c.lifecycle.Describe(ch)
+	}
+
+	if c.collectors[ServerBlocksCollector] {
+		for _, metric := range c.serverBlockMetrics {
+			ch <- metric
+		}
+	}
+
+	if c.collectors[ClientsCollector] {
+		for _, metric := range c.clientMetrics {
+			ch <- metric
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// readStats returns the stats page served by the mock server
+func readStats(t testing.TB) []byte {
+	t.Helper()
+	content, err := os.ReadFile("../tests/stats.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// slowFetcher serves a stats page after a delay, counting its fetches
+type slowFetcher struct {
+	page    []byte
+	delay   time.Duration
+	fetches atomic.Int32
+}
+
+func (f *slowFetcher) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	f.fetches.Add(1)
+	select {
+	case <-time.After(f.delay):
+		return io.NopCloser(bytes.NewReader(f.page)), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stallingReader reads a page until cut, then blocks until ctx is done
+type stallingReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		<-r.ctx.Done()
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+// collect collects c within ctx, returning the metrics by name
+func collect(t *testing.T, ctx context.Context, c *Collector) map[string][]*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.CollectContext(ctx, ch)
+		close(ch)
+	}()
+	metrics := make(map[string][]*dto.Metric)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Error(err)
+			continue
+		}
+		// The name is the only quoted string at the start of the description
+		name := strings.SplitN(m.Desc().String(), `"`, 3)[1]
+		metrics[name] = append(metrics[name], &pb)
+	}
+	return metrics
+}
+
+// up returns the value of nginx_rtmp_up
+func up(t *testing.T, metrics map[string][]*dto.Metric) float64 {
+	t.Helper()
+	if len(metrics["nginx_rtmp_up"]) != 1 {
+		t.Fatalf("nginx_rtmp_up exported %d times, want once", len(metrics["nginx_rtmp_up"]))
+	}
+	return metrics["nginx_rtmp_up"][0].GetGauge().GetValue()
+}
+
+func TestCollectSharedScrapeDeadlines(t *testing.T) {
+	fetcher := &slowFetcher{page: readStats(t), delay: 300 * time.Millisecond}
+	c, err := New(WithFetcher(fetcher), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := make(chan map[string][]*dto.Metric)
+	go func() { results <- collect(t, short, c) }()
+	time.Sleep(10 * time.Millisecond)
+	long := collect(t, context.Background(), c)
+	first := <-results
+
+	if got := up(t, first); got != 0 {
+		t.Errorf("up of the collect with the short deadline = %v, want 0", got)
+	}
+	if got := up(t, long); got != 1 {
+		t.Errorf("up of the collect without deadline = %v, want 1", got)
+	}
+	if len(long["nginx_rtmp_stream_incoming_bytes_total"]) != 6 {
+		t.Errorf("collect without deadline exported %d streams, want 6", len(long["nginx_rtmp_stream_incoming_bytes_total"]))
+	}
+	if got := fetcher.fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1 shared by the collects", got)
+	}
+}
+
+func TestCollectPartialScrape(t *testing.T) {
+	page := readStats(t)
+	page = page[:bytes.Index(page, []byte("<name>hls</name>"))]
+	c, err := New(WithFetcher(FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(&stallingReader{ctx: ctx, r: bytes.NewReader(page)}), nil
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	metrics := collect(t, ctx, c)
+	if got := up(t, metrics); got != 0 {
+		t.Errorf("up = %v, want 0", got)
+	}
+	// Only the stream before the cut was decoded
+	if len(metrics["nginx_rtmp_stream_incoming_bytes_total"]) != 1 {
+		t.Errorf("exported %d streams, want the one before the cut", len(metrics["nginx_rtmp_stream_incoming_bytes_total"]))
+	}
+}
+
+func TestCollectFlightGrace(t *testing.T) {
+	// The fetcher doesn't give up at the deadline
+	release := make(chan struct{})
+	defer close(release)
+	c, err := New(WithFetcher(FetcherFunc(func(context.Context) (io.ReadCloser, error) {
+		<-release
+		return nil, errors.New("released")
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	metrics := collect(t, ctx, c)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond+flightGrace+200*time.Millisecond {
+		t.Errorf("collect returned after %s, want the deadline and the grace", elapsed)
+	}
+	if got := up(t, metrics); got != 0 {
+		t.Errorf("up = %v, want 0", got)
+	}
+	if duration := metrics["nginx_rtmp_scrape_duration_seconds"][0].GetGauge().GetValue(); duration < 0.05 {
+		t.Errorf("scrape duration = %v, want at least the deadline", duration)
+	}
+}
+
+func TestCollectSharedScrape(t *testing.T) {
+	fetcher := &slowFetcher{page: readStats(t), delay: 100 * time.Millisecond}
+	c, err := New(WithFetcher(fetcher))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan map[string][]*dto.Metric)
+	for i := 0; i < 5; i++ {
+		go func() { results <- collect(t, context.Background(), c) }()
+	}
+	for i := 0; i < 5; i++ {
+		metrics := <-results
+		if got := up(t, metrics); got != 1 {
+			t.Errorf("up = %v, want 1", got)
+		}
+		if len(metrics["nginx_rtmp_stream_incoming_bytes_total"]) != 6 {
+			t.Errorf("exported %d streams, want 6", len(metrics["nginx_rtmp_stream_incoming_bytes_total"]))
+		}
+	}
+	if got := fetcher.fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1 shared by the collects", got)
+	}
+
+	// A collect after the scrape ended scrapes again
+	collect(t, context.Background(), c)
+	if got := fetcher.fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
+
+// pageFetcher serves a stats page
+func pageFetcher(page []byte) Fetcher {
+	return FetcherFunc(func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(page)), nil
+	})
+}
+
+// twoServers returns a stats page with its server block twice
+func twoServers(page []byte) []byte {
+	start := bytes.Index(page, []byte("<server>"))
+	end := bytes.Index(page, []byte("</server>")) + len("</server>")
+	block := page[start:end]
+	return append(append(append([]byte{}, page[:end]...), block...), page[end:]...)
+}
+
+func TestCollectRepeatedStreamLabels(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		opts := []Option{WithFetcher(pageFetcher(twoServers(readStats(t))))}
+		if legacy {
+			opts = append(opts, WithLegacyStreamLabel())
+		}
+		c, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(c)
+		// The second scrape has the reconnects of the streams too
+		for i := 0; i < 2; i++ {
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("legacy label %v: %v", legacy, err)
+			}
+			want := 12
+			if legacy {
+				want = 6 // the streams of the second server block are skipped
+			}
+			found := 0
+			for _, family := range families {
+				switch family.GetName() {
+				case "nginx_rtmp_stream_incoming_bytes_total", "nginx_rtmp_stream_reconnects_total":
+					found++
+					if len(family.GetMetric()) != want {
+						t.Errorf("legacy label %v: %d %s series, want %d", legacy, len(family.GetMetric()), family.GetName(), want)
+					}
+				}
+			}
+			if found != 2 {
+				t.Errorf("legacy label %v: %d of the stream families exported, want 2", legacy, found)
+			}
+		}
+	}
+}
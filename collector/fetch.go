@@ -0,0 +1,245 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/config"
+)
+
+// Fetcher fetches the stats document of NGINX-RTMP
+type Fetcher interface {
+	Fetch(ctx context.Context) (io.ReadCloser, error)
+}
+
+// FetcherFunc is an adapter to use ordinary functions as fetchers
+type FetcherFunc func(ctx context.Context) (io.ReadCloser, error)
+
+func (f FetcherFunc) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	return f(ctx)
+}
+
+// StatusError is returned by fetchers when NGINX-RTMP answers with a non-2xx
+// HTTP status
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d", int(e))
+}
+
+// HTTPConfig configures the HTTP client of the http(s):// and unix://
+// fetchers: authentication, TLS and extra headers. Password, token and TLS
+// files are read again when they change, so credentials can be rotated
+// without a restart.
+type HTTPConfig struct {
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// DefaultHTTPConfig follows redirects and enables HTTP/2, without
+// authentication
+var DefaultHTTPConfig = HTTPConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (c *HTTPConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultHTTPConfig
+	type plain HTTPConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return c.HTTPClientConfig.Validate()
+}
+
+// NewFetcher returns the fetcher of the stats document for the scheme of uri:
+//
+//   - http:// and https:// fetch it over HTTP
+//   - file:///var/run/rtmp-stat.xml reads it from a file
+//   - unix:///var/run/nginx.sock:/stats fetches the /stats location over HTTP
+//     from a unix domain socket
+//
+// The host of file:// and unix:// URIs can only be empty or localhost.
+func NewFetcher(uri string, timeout time.Duration, httpConfig HTTPConfig) (Fetcher, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme == "file" || u.Scheme == "unix") && u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("unsupported host %q in %q, local paths start with %s:///", u.Host, uri, u.Scheme)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPFetcher(uri, timeout, httpConfig)
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("no path in %q", uri)
+		}
+		return NewFileFetcher(u.Path), nil
+	case "unix":
+		socket, path, _ := strings.Cut(u.Path, ":")
+		if socket == "" {
+			return nil, fmt.Errorf("no socket in %q", uri)
+		}
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+		return NewUnixFetcher(socket, path, timeout, httpConfig)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in %q", u.Scheme, uri)
+	}
+}
+
+// NewHTTPFetcher fetches the stats document from an HTTP URI
+func NewHTTPFetcher(uri string, timeout time.Duration, httpConfig HTTPConfig) (Fetcher, error) {
+	client, err := newHTTPClient(timeout, httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPFetcher(uri, client), nil
+}
+
+// NewUnixFetcher fetches the stats document from the given location of an
+// HTTP server listening on a unix domain socket
+func NewUnixFetcher(socket, path string, timeout time.Duration, httpConfig HTTPConfig) (Fetcher, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	client, err := newHTTPClient(timeout, httpConfig, config.WithDialContextFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPFetcher("http://localhost"+path, client), nil
+}
+
+func newHTTPClient(timeout time.Duration, httpConfig HTTPConfig, opts ...config.HTTPClientOption) (*http.Client, error) {
+	if err := httpConfig.HTTPClientConfig.Validate(); err != nil {
+		return nil, err
+	}
+	client, err := config.NewClientFromConfig(httpConfig.HTTPClientConfig, "nginx_rtmp", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(httpConfig.Headers) > 0 {
+		client.Transport = &headersRoundTripper{headers: httpConfig.Headers, next: client.Transport}
+	}
+	client.Timeout = timeout
+	return client, nil
+}
+
+// headersRoundTripper adds headers to every request
+type headersRoundTripper struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (rt *headersRoundTripper) CloseIdleConnections() {
+	if ci, ok := rt.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+func (rt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range rt.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// NewFileFetcher reads the stats document from a file, for example one
+// written periodically by curl
+func NewFileFetcher(path string) Fetcher {
+	return FetcherFunc(func(context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+}
+
+// httpFetcher fetches the stats document with an HTTP client
+type httpFetcher struct {
+	uri    string
+	client *http.Client
+}
+
+func newHTTPFetcher(uri string, client *http.Client) Fetcher {
+	return &httpFetcher{uri: uri, client: client}
+}
+
+func (f *httpFetcher) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		resp.Body.Close()
+		return nil, StatusError(resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// CloseIdleConnections closes the keep-alive connections of the fetcher, to
+// call when it is no longer used
+func (f *httpFetcher) CloseIdleConnections() {
+	f.client.CloseIdleConnections()
+}
+
+// CloseIdleConnections closes the keep-alive connections of fetcher, if it
+// has some
+func CloseIdleConnections(fetcher Fetcher) {
+	if ci, ok := fetcher.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// contextReader stops reading the stats document once ctx is done, so the
+// deadline of a scrape bounds its parsing too
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,245 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package collector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/config"
+)
+
+// requestURIServer answers the request URI of each request
+var requestURIServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.URL.RequestURI())
+})
+
+func TestNewFetcher(t *testing.T) {
+	web := httptest.NewServer(requestURIServer)
+	defer web.Close()
+
+	// Unix socket paths are short, temporary directories of tests may not be
+	dir, err := os.MkdirTemp("", "rtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "nginx.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := httptest.NewUnstartedServer(requestURIServer)
+	unix.Listener = listener
+	unix.Start()
+	defer unix.Close()
+
+	file := filepath.Join(dir, "stats.xml")
+	if err := os.WriteFile(file, []byte("<rtmp></rtmp>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    string // the document fetched
+		invalid bool
+	}{
+		{name: "http", uri: web.URL + "/stats?app=live", want: "/stats?app=live"},
+		{name: "file", uri: "file://" + file, want: "<rtmp></rtmp>"},
+		{name: "file on localhost", uri: "file://localhost" + file, want: "<rtmp></rtmp>"},
+		{name: "unix", uri: "unix://" + socket + ":/stats", want: "/stats"},
+		{name: "unix without slash", uri: "unix://" + socket + ":stats", want: "/stats"},
+		{name: "unix with query", uri: "unix://" + socket + ":/stats?app=live", want: "/stats?app=live"},
+		{name: "unix on localhost", uri: "unix://localhost" + socket + ":/stats", want: "/stats"},
+		{name: "file with host", uri: "file://var/run/rtmp-stat.xml", invalid: true},
+		{name: "file without path", uri: "file://", invalid: true},
+		{name: "unix with host", uri: "unix://var/run/nginx.sock:/stats", invalid: true},
+		{name: "unix without socket", uri: "unix://:/stats", invalid: true},
+		{name: "unsupported scheme", uri: "ftp://localhost/stats", invalid: true},
+		{name: "no scheme", uri: "localhost:8080/stats", invalid: true},
+		{name: "malformed", uri: "http://local host/stats", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher, err := NewFetcher(test.uri, time.Second, DefaultHTTPConfig)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("%q accepted", test.uri)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseIdleConnections(fetcher)
+
+			body, err := fetcher.Fetch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("fetched %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTTPFetcherStatus(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	fetcher, err := NewFetcher(server.URL+"/stats", time.Second, DefaultHTTPConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseIdleConnections(fetcher)
+	if _, err := fetcher.Fetch(context.Background()); err != StatusError(http.StatusNotFound) {
+		t.Errorf("fetch error %v, want %v", err, StatusError(http.StatusNotFound))
+	}
+}
+
+// headerServer records the host and headers of the last request
+type headerServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	host   string
+	header http.Header
+}
+
+func newHeaderServer(t *testing.T) *headerServer {
+	t.Helper()
+	s := &headerServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.host, s.header = r.Host, r.Header.Clone()
+		s.mutex.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fetch fetches the stats document with fetcher, returning the host and
+// headers received by the server
+func (s *headerServer) fetch(t *testing.T, fetcher Fetcher) (string, http.Header) {
+	t.Helper()
+	body, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.host, s.header
+}
+
+// writeFile replaces the content of the file at path
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPFetcherHeaders(t *testing.T) {
+	server := newHeaderServer(t)
+	httpConfig := DefaultHTTPConfig
+	httpConfig.Headers = map[string]string{"X-Api-Key": "secret", "Host": "rtmp.example.com"}
+	fetcher, err := NewHTTPFetcher(server.URL+"/stats", time.Second, httpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseIdleConnections(fetcher)
+
+	host, header := server.fetch(t, fetcher)
+	if host != "rtmp.example.com" {
+		t.Errorf("host %q, want %q", host, "rtmp.example.com")
+	}
+	if got := header.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("X-Api-Key %q, want %q", got, "secret")
+	}
+}
+
+func TestHTTPFetcherCredentials(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	writeFile(t, passwordFile, "first")
+
+	tests := []struct {
+		name string
+		auth func(*config.HTTPClientConfig)
+		want func(password string) string // the Authorization header
+	}{
+		{
+			name: "basic auth",
+			auth: func(c *config.HTTPClientConfig) {
+				c.BasicAuth = &config.BasicAuth{Username: "user", PasswordFile: passwordFile}
+			},
+			want: func(password string) string {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.SetBasicAuth("user", password)
+				return req.Header.Get("Authorization")
+			},
+		},
+		{
+			name: "bearer token",
+			auth: func(c *config.HTTPClientConfig) {
+				c.Authorization = &config.Authorization{Type: "Bearer", CredentialsFile: passwordFile}
+			},
+			want: func(token string) string { return "Bearer " + token },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeFile(t, passwordFile, "first")
+			server := newHeaderServer(t)
+			httpConfig := DefaultHTTPConfig
+			test.auth(&httpConfig.HTTPClientConfig)
+			fetcher, err := NewHTTPFetcher(server.URL+"/stats", time.Second, httpConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseIdleConnections(fetcher)
+
+			if _, header := server.fetch(t, fetcher); header.Get("Authorization") != test.want("first") {
+				t.Errorf("Authorization %q, want %q", header.Get("Authorization"), test.want("first"))
+			}
+			// Rotated credentials are used without creating a new fetcher
+			writeFile(t, passwordFile, "second")
+			if _, header := server.fetch(t, fetcher); header.Get("Authorization") != test.want("second") {
+				t.Errorf("Authorization %q after rotation, want %q", header.Get("Authorization"), test.want("second"))
+			}
+		})
+	}
+}
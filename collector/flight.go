@@ -0,0 +1,108 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// flight is a scrape shared by the collects waiting for it. It goes on until
+// the latest deadline of its collects, so that a collect with a short deadline
+// doesn't cut it short for the others.
+type flight struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer // cancels the scrape at the deadline
+	deadline time.Time
+	bounded  bool // false once a collect without deadline joined
+	done     chan struct{}
+	result   *scrapeResult
+}
+
+// scrapeResult is a scrape shared by the collects waiting for it
+type scrapeResult struct {
+	metrics []prometheus.Metric
+	health  health
+}
+
+// join returns the scrape in flight, starting one when there is none, and
+// extends it to the deadline of ctx
+func (c *Collector) join(ctx context.Context) *flight {
+	c.flightMutex.Lock()
+	defer c.flightMutex.Unlock()
+
+	f := c.flight
+	// A scrape that reached its deadline is ending, its metrics would be partial
+	if f == nil || f.ctx.Err() != nil {
+		f = &flight{bounded: true, done: make(chan struct{})}
+		// The scrape isn't canceled with the collect that started it, only
+		// bounded by the timeout of the collector
+		f.ctx, f.cancel = c.scrapeContext(context.WithoutCancel(ctx))
+		c.flight = f
+		go c.fly(f)
+	}
+	f.extend(ctx)
+	return f
+}
+
+// extend pushes the deadline of the flight back to the one of ctx
+func (f *flight) extend(ctx context.Context) {
+	if !f.bounded {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	switch {
+	case !ok:
+		f.bounded = false
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+	case f.timer == nil:
+		f.deadline = deadline
+		f.timer = time.AfterFunc(time.Until(deadline), f.cancel)
+	case deadline.After(f.deadline):
+		f.deadline = deadline
+		f.timer.Reset(time.Until(deadline))
+	}
+}
+
+// fly scrapes NGINX-RTMP for the collects of the flight
+func (c *Collector) fly(f *flight) {
+	defer f.cancel()
+	var metrics []prometheus.Metric
+	result := c.observe(f.ctx, func(m prometheus.Metric) { metrics = append(metrics, m) })
+	f.result = &scrapeResult{metrics: metrics, health: c.record(result)}
+
+	c.flightMutex.Lock()
+	if c.flight == f {
+		c.flight = nil
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	c.flightMutex.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,241 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/rtmpstat"
+)
+
+// metricsHandler sends the metrics of the parts of the stats document as
+// soon as they are decoded. Applications and server blocks are summed from
+// their streams on the way.
+type metricsHandler struct {
+	c    *Collector
+	send func(prometheus.Metric)
+
+	streams     float64
+	seen        map[streamKey]rtmpstat.Stream // nil without lifecycle tracking
+	exported    map[streamKey][]string        // label values of the streams exported
+	labelled    map[string]bool               // joined label values of the streams exported
+	stream      clientCount
+	live        clientCount
+	application totals
+	block       totals
+}
+
+// clientCount counts the clients listed in a stream or live section
+type clientCount struct {
+	listed     float64
+	publishers float64
+	players    int // exported ones
+}
+
+// totals of an application or a server block
+type totals struct {
+	bytesIn, bytesOut         float64
+	bandwidthIn, bandwidthOut float64 // in bits per second
+	streams                   float64
+	publishers, players       float64
+}
+
+func (h *metricsHandler) Client(loc rtmpstat.Location, client rtmpstat.Client) {
+	c := h.c
+	h.stream.add(client)
+	if loc.Section == "live" {
+		h.live.add(client)
+	}
+	if !c.collectors[ClientsCollector] {
+		return
+	}
+	role := "publisher"
+	if !client.Publishing {
+		if c.maxClientsPerStream > 0 && h.stream.players >= c.maxClientsPerStream {
+			return
+		}
+		h.stream.players++
+		role = "player"
+	}
+	labels := []string{strconv.Itoa(loc.Server), loc.Application, c.streamNameNormalizer(loc.Stream), role, client.Address, client.ID}
+	h.sendMetric(c.clientMetrics["uptime"], prometheus.CounterValue, client.Time, labels...)
+	h.sendMetric(c.clientMetrics["dropped"], prometheus.CounterValue, client.Dropped, labels...)
+	h.sendMetric(c.clientMetrics["avsync"], prometheus.GaugeValue, client.AVSync, labels...)
+}
+
+func (h *metricsHandler) Stream(loc rtmpstat.Location, stream rtmpstat.Stream) {
+	c := h.c
+	publishers, players := h.stream.split(stream.NClients)
+	h.stream = clientCount{}
+	h.streams++
+	if h.seen != nil {
+		h.seen[streamKey{loc.Server, loc.Application, loc.Section, stream.Name}] = stream
+	}
+	h.application.streams++
+	addValue(&h.application.bytesIn, stream.BytesIn)
+	addValue(&h.application.bytesOut, stream.BytesOut)
+	addValue(&h.application.bandwidthIn, stream.BandwidthIn)
+	addValue(&h.application.bandwidthOut, stream.BandwidthOut)
+	if !c.collectors[StreamsCollector] {
+		return
+	}
+
+	labels := c.streamLabelValues(strconv.Itoa(loc.Server), loc.Application, c.streamNameNormalizer(stream.Name))
+	// Streams of several server blocks under the legacy label, of the live and
+	// play sections, or with names rewritten to the same one, would have the
+	// same labels. Duplicate series would fail the whole scrape.
+	id := strings.Join(labels, "\xff")
+	if h.labelled[id] {
+		level.Warn(c.logger).Log("msg", "Skipped a stream with the same labels as another one", "server", loc.Server, "application", loc.Application, "section", loc.Section, "stream", stream.Name)
+		return
+	}
+	h.labelled[id] = true
+	h.exported[streamKey{loc.Server, loc.Application, loc.Section, stream.Name}] = labels
+
+	h.sendMetric(c.streamMetrics["bytesIn"], prometheus.CounterValue, stream.BytesIn, labels...)
+	h.sendMetric(c.streamMetrics["bytesOut"], prometheus.CounterValue, stream.BytesOut, labels...)
+	h.sendMetric(c.streamMetrics["bandwidthIn"], prometheus.GaugeValue, c.bandwidth(stream.BandwidthIn), labels...)
+	h.sendMetric(c.streamMetrics["bandwidthOut"], prometheus.GaugeValue, c.bandwidth(stream.BandwidthOut), labels...)
+	h.sendMetric(c.streamMetrics["uptime"], prometheus.CounterValue, stream.Time, labels...)
+	if c.naming == V2Naming {
+		h.sendMetric(c.streamMetrics["bandwidthAudio"], prometheus.GaugeValue, c.bandwidth(stream.BandwidthAudio), labels...)
+		h.sendMetric(c.streamMetrics["bandwidthVideo"], prometheus.GaugeValue, c.bandwidth(stream.BandwidthVideo), labels...)
+	}
+	h.sendMetric(c.streamMetrics["clients"], prometheus.GaugeValue, publishers, withLabels(labels, "publisher")...)
+	h.sendMetric(c.streamMetrics["clients"], prometheus.GaugeValue, players, withLabels(labels, "player")...)
+
+	if video := stream.Meta.Video; video != nil {
+		h.sendMetric(c.streamMetrics["videoInfo"], prometheus.GaugeValue, 1, withLabels(labels, video.Codec, video.Profile, video.Level)...)
+		h.sendMetric(c.streamMetrics["videoWidth"], prometheus.GaugeValue, video.Width, labels...)
+		h.sendMetric(c.streamMetrics["videoHeight"], prometheus.GaugeValue, video.Height, labels...)
+		h.sendMetric(c.streamMetrics["videoFrameRate"], prometheus.GaugeValue, video.FrameRate, labels...)
+	}
+	if audio := stream.Meta.Audio; audio != nil {
+		h.sendMetric(c.streamMetrics["audioInfo"], prometheus.GaugeValue, 1, withLabels(labels, audio.Codec, audio.Profile)...)
+		h.sendMetric(c.streamMetrics["audioChannels"], prometheus.GaugeValue, audio.Channels, labels...)
+		h.sendMetric(c.streamMetrics["audioSampleRate"], prometheus.GaugeValue, audio.SampleRate, labels...)
+	}
+}
+
+func (h *metricsHandler) Application(loc rtmpstat.Location, application rtmpstat.Application) {
+	c := h.c
+	app := h.application
+	if application.Live != nil {
+		app.publishers, app.players = h.live.split(application.Live.NClients)
+	}
+	h.application, h.live = totals{}, clientCount{}
+	h.block.add(app)
+	if !c.collectors[ApplicationsCollector] {
+		return
+	}
+
+	labels := []string{strconv.Itoa(loc.Server), application.Name}
+	h.sendMetric(c.applicationMetrics["bytesIn"], prometheus.CounterValue, app.bytesIn, labels...)
+	h.sendMetric(c.applicationMetrics["bytesOut"], prometheus.CounterValue, app.bytesOut, labels...)
+	h.sendMetric(c.applicationMetrics["bandwidthIn"], prometheus.GaugeValue, c.bandwidth(app.bandwidthIn), labels...)
+	h.sendMetric(c.applicationMetrics["bandwidthOut"], prometheus.GaugeValue, c.bandwidth(app.bandwidthOut), labels...)
+	h.sendMetric(c.applicationMetrics["currentStreams"], prometheus.GaugeValue, app.streams, labels...)
+	h.sendMetric(c.applicationMetrics["clients"], prometheus.GaugeValue, app.publishers, withLabels(labels, "publisher")...)
+	h.sendMetric(c.applicationMetrics["clients"], prometheus.GaugeValue, app.players, withLabels(labels, "player")...)
+}
+
+func (h *metricsHandler) Server(loc rtmpstat.Location, _ rtmpstat.Server) {
+	c := h.c
+	block := h.block
+	h.block = totals{}
+	if !c.collectors[ServerBlocksCollector] {
+		return
+	}
+
+	index := strconv.Itoa(loc.Server)
+	h.sendMetric(c.serverBlockMetrics["bytesIn"], prometheus.CounterValue, block.bytesIn, index)
+	h.sendMetric(c.serverBlockMetrics["bytesOut"], prometheus.CounterValue, block.bytesOut, index)
+	h.sendMetric(c.serverBlockMetrics["bandwidthIn"], prometheus.GaugeValue, c.bandwidth(block.bandwidthIn), index)
+	h.sendMetric(c.serverBlockMetrics["bandwidthOut"], prometheus.GaugeValue, c.bandwidth(block.bandwidthOut), index)
+	h.sendMetric(c.serverBlockMetrics["currentStreams"], prometheus.GaugeValue, block.streams, index)
+	h.sendMetric(c.serverBlockMetrics["clients"], prometheus.GaugeValue, block.publishers, index, "publisher")
+	h.sendMetric(c.serverBlockMetrics["clients"], prometheus.GaugeValue, block.players, index, "player")
+}
+
+func (h *metricsHandler) Stats(stats rtmpstat.Stats) {
+	c := h.c
+	h.sendMetric(c.serverMetrics["bytesIn"], prometheus.CounterValue, stats.BytesIn)
+	h.sendMetric(c.serverMetrics["bytesOut"], prometheus.CounterValue, stats.BytesOut)
+	h.sendMetric(c.serverMetrics["bandwidthIn"], prometheus.GaugeValue, c.bandwidth(stats.BandwidthIn))
+	h.sendMetric(c.serverMetrics["bandwidthOut"], prometheus.GaugeValue, c.bandwidth(stats.BandwidthOut))
+	h.sendMetric(c.serverMetrics["uptime"], prometheus.CounterValue, stats.Uptime)
+	h.sendMetric(c.serverMetrics["accepted"], prometheus.CounterValue, stats.Accepted)
+	h.sendMetric(c.serverMetrics["info"], prometheus.GaugeValue, 1, stats.NginxVersion, stats.NginxRTMPVersion, stats.Compiler, stats.Built)
+	h.sendMetric(c.serverMetrics["currentStreams"], prometheus.GaugeValue, h.streams)
+}
+
+// add counts a listed client
+func (c *clientCount) add(client rtmpstat.Client) {
+	c.listed++
+	if client.Publishing {
+		c.publishers++
+	}
+}
+
+// split splits the <nclients> of a stream or live section into publishers and
+// players. The listed clients are used when it is missing.
+func (c clientCount) split(total float64) (float64, float64) {
+	if math.IsNaN(total) {
+		total = c.listed
+	}
+	if c.publishers > total {
+		total = c.publishers
+	}
+	return c.publishers, total - c.publishers
+}
+
+// add sums the totals of an application into a server block
+func (t *totals) add(o totals) {
+	t.bytesIn += o.bytesIn
+	t.bytesOut += o.bytesOut
+	t.bandwidthIn += o.bandwidthIn
+	t.bandwidthOut += o.bandwidthOut
+	t.streams += o.streams
+	t.publishers += o.publishers
+	t.players += o.players
+}
+
+// addValue adds value to sum, unless it is missing from the stats document
+func addValue(sum *float64, value float64) {
+	if !math.IsNaN(value) {
+		*sum += value
+	}
+}
+
+// sendMetric sends a metric, unless its value is missing from the stats document
+func (h *metricsHandler) sendMetric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) {
+	if math.IsNaN(value) {
+		return
+	}
+	h.send(prometheus.MustNewConstMetric(desc, valueType, value, labelValues...))
+}
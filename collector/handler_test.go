@@ -0,0 +1,393 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// compareMetrics checks the given metrics of a collector of the stats page
+// against the expected text exposition
+func compareMetrics(t *testing.T, page []byte, opts []Option, expected string, names ...string) {
+	t.Helper()
+	c, err := New(append(opts, WithFetcher(pageFetcher(page)))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	// Two more players of the hello stream
+	player := `<client><id>%s</id><address>10.0.0.%s</address><time>5000</time><dropped>3</dropped><avsync>20</avsync><active /></client>`
+	page := bytes.Replace(readStats(t), []byte("<meta>"), []byte(
+		strings.ReplaceAll(player, "%s", "10")+strings.ReplaceAll(player, "%s", "11")+"<meta>"), 1)
+
+	compareMetrics(t, page, []Option{WithCollectors(ClientsCollector), WithMaxClientsPerStream(2)}, `
+# HELP nginx_rtmp_client_uptime_seconds_total Number of seconds since the client connected
+# TYPE nginx_rtmp_client_uptime_seconds_total counter
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="stream",id="2",role="player",server="0",stream="hello"} 118.37
+nginx_rtmp_client_uptime_seconds_total{address="10.0.0.10",application="stream",id="10",role="player",server="0",stream="hello"} 5
+nginx_rtmp_client_uptime_seconds_total{address="172.17.0.1",application="stream",id="1",role="publisher",server="0",stream="hello"} 119.15
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="hls",id="6",role="publisher",server="0",stream="hello_360p878kbs"} 112.805
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="hls",id="8",role="publisher",server="0",stream="hello_240p264kbs"} 112.715
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="hls",id="7",role="publisher",server="0",stream="hello_240p528kbs"} 112.765
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="hls",id="4",role="publisher",server="0",stream="hello_720p2628kbs"} 112.925
+nginx_rtmp_client_uptime_seconds_total{address="127.0.0.1",application="hls",id="5",role="publisher",server="0",stream="hello_480p1128kbs"} 112.865
+# HELP nginx_rtmp_client_dropped_frames_total Number of frames dropped while sending to the client
+# TYPE nginx_rtmp_client_dropped_frames_total counter
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="stream",id="2",role="player",server="0",stream="hello"} 0
+nginx_rtmp_client_dropped_frames_total{address="10.0.0.10",application="stream",id="10",role="player",server="0",stream="hello"} 3
+nginx_rtmp_client_dropped_frames_total{address="172.17.0.1",application="stream",id="1",role="publisher",server="0",stream="hello"} 0
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="hls",id="6",role="publisher",server="0",stream="hello_360p878kbs"} 0
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="hls",id="8",role="publisher",server="0",stream="hello_240p264kbs"} 0
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="hls",id="7",role="publisher",server="0",stream="hello_240p528kbs"} 0
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="hls",id="4",role="publisher",server="0",stream="hello_720p2628kbs"} 0
+nginx_rtmp_client_dropped_frames_total{address="127.0.0.1",application="hls",id="5",role="publisher",server="0",stream="hello_480p1128kbs"} 0
+`, "nginx_rtmp_client_uptime_seconds_total", "nginx_rtmp_client_dropped_frames_total")
+
+	// Without a limit, every player is exported
+	c, err := New(WithFetcher(pageFetcher(page)), WithCollectors(ClientsCollector), WithMaxClientsPerStream(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(c, "nginx_rtmp_client_avsync_seconds"); got != 9 {
+		t.Errorf("exported %d clients, want 9", got)
+	}
+}
+
+func TestStreamMetadata(t *testing.T) {
+	videoNames := []string{"nginx_rtmp_stream_video_info", "nginx_rtmp_stream_video_width_pixels", "nginx_rtmp_stream_video_height_pixels", "nginx_rtmp_stream_video_frame_rate"}
+	audioNames := []string{"nginx_rtmp_stream_audio_info", "nginx_rtmp_stream_audio_channels", "nginx_rtmp_stream_audio_sample_rate_hertz"}
+
+	// Every stream of the page has an empty <audio />, which exports no audio series
+	compareMetrics(t, readStats(t), nil, `
+# HELP nginx_rtmp_stream_video_frame_rate Video frames per second declared by the publisher
+# TYPE nginx_rtmp_stream_video_frame_rate gauge
+nginx_rtmp_stream_video_frame_rate{application="hls",server="0",stream="hello_240p264kbs"} 15
+nginx_rtmp_stream_video_frame_rate{application="hls",server="0",stream="hello_240p528kbs"} 30
+nginx_rtmp_stream_video_frame_rate{application="hls",server="0",stream="hello_360p878kbs"} 30
+nginx_rtmp_stream_video_frame_rate{application="hls",server="0",stream="hello_480p1128kbs"} 30
+nginx_rtmp_stream_video_frame_rate{application="hls",server="0",stream="hello_720p2628kbs"} 30
+nginx_rtmp_stream_video_frame_rate{application="stream",server="0",stream="hello"} 30
+# HELP nginx_rtmp_stream_video_height_pixels Video height declared by the publisher
+# TYPE nginx_rtmp_stream_video_height_pixels gauge
+nginx_rtmp_stream_video_height_pixels{application="hls",server="0",stream="hello_240p264kbs"} 240
+nginx_rtmp_stream_video_height_pixels{application="hls",server="0",stream="hello_240p528kbs"} 240
+nginx_rtmp_stream_video_height_pixels{application="hls",server="0",stream="hello_360p878kbs"} 360
+nginx_rtmp_stream_video_height_pixels{application="hls",server="0",stream="hello_480p1128kbs"} 480
+nginx_rtmp_stream_video_height_pixels{application="hls",server="0",stream="hello_720p2628kbs"} 720
+nginx_rtmp_stream_video_height_pixels{application="stream",server="0",stream="hello"} 720
+# HELP nginx_rtmp_stream_video_info Video metadata declared by the publisher
+# TYPE nginx_rtmp_stream_video_info gauge
+nginx_rtmp_stream_video_info{application="hls",codec="H264",level="2.1",profile="Baseline",server="0",stream="hello_240p264kbs"} 1
+nginx_rtmp_stream_video_info{application="hls",codec="H264",level="2.1",profile="Baseline",server="0",stream="hello_240p528kbs"} 1
+nginx_rtmp_stream_video_info{application="hls",codec="H264",level="3.0",profile="Baseline",server="0",stream="hello_360p878kbs"} 1
+nginx_rtmp_stream_video_info{application="hls",codec="H264",level="3.1",profile="Baseline",server="0",stream="hello_480p1128kbs"} 1
+nginx_rtmp_stream_video_info{application="hls",codec="H264",level="3.1",profile="Baseline",server="0",stream="hello_720p2628kbs"} 1
+nginx_rtmp_stream_video_info{application="stream",codec="H264",level="3.1",profile="High",server="0",stream="hello"} 1
+# HELP nginx_rtmp_stream_video_width_pixels Video width declared by the publisher
+# TYPE nginx_rtmp_stream_video_width_pixels gauge
+nginx_rtmp_stream_video_width_pixels{application="hls",server="0",stream="hello_240p264kbs"} 426
+nginx_rtmp_stream_video_width_pixels{application="hls",server="0",stream="hello_240p528kbs"} 426
+nginx_rtmp_stream_video_width_pixels{application="hls",server="0",stream="hello_360p878kbs"} 640
+nginx_rtmp_stream_video_width_pixels{application="hls",server="0",stream="hello_480p1128kbs"} 854
+nginx_rtmp_stream_video_width_pixels{application="hls",server="0",stream="hello_720p2628kbs"} 1280
+nginx_rtmp_stream_video_width_pixels{application="stream",server="0",stream="hello"} 1280
+`, append(videoNames, audioNames...)...)
+
+	// The audio metadata of a publisher that declares it
+	page := bytes.Replace(readStats(t), []byte("<audio />"), []byte(
+		"<audio><codec>AAC</codec><profile>LC</profile><channels>2</channels><sample_rate>44100</sample_rate></audio>"), 1)
+	compareMetrics(t, page, nil, `
+# HELP nginx_rtmp_stream_audio_channels Number of audio channels declared by the publisher
+# TYPE nginx_rtmp_stream_audio_channels gauge
+nginx_rtmp_stream_audio_channels{application="stream",server="0",stream="hello"} 2
+# HELP nginx_rtmp_stream_audio_info Audio metadata declared by the publisher
+# TYPE nginx_rtmp_stream_audio_info gauge
+nginx_rtmp_stream_audio_info{application="stream",codec="AAC",profile="LC",server="0",stream="hello"} 1
+# HELP nginx_rtmp_stream_audio_sample_rate_hertz Audio sample rate declared by the publisher
+# TYPE nginx_rtmp_stream_audio_sample_rate_hertz gauge
+nginx_rtmp_stream_audio_sample_rate_hertz{application="stream",server="0",stream="hello"} 44100
+`, audioNames...)
+}
+
+func TestViewerCounts(t *testing.T) {
+	hlsClients := `nginx_rtmp_stream_clients{application="hls",role="publisher",server="0",stream="hello_360p878kbs"} 1
+nginx_rtmp_stream_clients{application="hls",role="player",server="0",stream="hello_360p878kbs"} 0
+nginx_rtmp_stream_clients{application="hls",role="publisher",server="0",stream="hello_240p264kbs"} 1
+nginx_rtmp_stream_clients{application="hls",role="player",server="0",stream="hello_240p264kbs"} 0
+nginx_rtmp_stream_clients{application="hls",role="publisher",server="0",stream="hello_240p528kbs"} 1
+nginx_rtmp_stream_clients{application="hls",role="player",server="0",stream="hello_240p528kbs"} 0
+nginx_rtmp_stream_clients{application="hls",role="publisher",server="0",stream="hello_720p2628kbs"} 1
+nginx_rtmp_stream_clients{application="hls",role="player",server="0",stream="hello_720p2628kbs"} 0
+nginx_rtmp_stream_clients{application="hls",role="publisher",server="0",stream="hello_480p1128kbs"} 1
+nginx_rtmp_stream_clients{application="hls",role="player",server="0",stream="hello_480p1128kbs"} 0
+`
+	tests := []struct {
+		name     string
+		edit     func([]byte) []byte
+		expected string
+	}{
+		{
+			name: "listed clients",
+			expected: `
+# HELP nginx_rtmp_stream_clients Current number of clients connected to the stream
+# TYPE nginx_rtmp_stream_clients gauge
+nginx_rtmp_stream_clients{application="stream",role="publisher",server="0",stream="hello"} 1
+nginx_rtmp_stream_clients{application="stream",role="player",server="0",stream="hello"} 1
+` + hlsClients + `# HELP nginx_rtmp_application_clients Current number of clients connected to the application
+# TYPE nginx_rtmp_application_clients gauge
+nginx_rtmp_application_clients{application="stream",role="publisher",server="0"} 1
+nginx_rtmp_application_clients{application="stream",role="player",server="0"} 1
+nginx_rtmp_application_clients{application="hls",role="publisher",server="0"} 5
+nginx_rtmp_application_clients{application="hls",role="player",server="0"} 0
+`,
+		},
+		{
+			// The players of the stream aren't all listed, the live section
+			// doesn't count its clients
+			name: "nclients",
+			edit: func(page []byte) []byte {
+				page = bytes.Replace(page, []byte("<nclients>2</nclients>"), []byte("<nclients>10</nclients>"), 1)
+				return bytes.Replace(page, []byte("<nclients>2</nclients>"), nil, 1)
+			},
+			expected: `
+# HELP nginx_rtmp_stream_clients Current number of clients connected to the stream
+# TYPE nginx_rtmp_stream_clients gauge
+nginx_rtmp_stream_clients{application="stream",role="publisher",server="0",stream="hello"} 1
+nginx_rtmp_stream_clients{application="stream",role="player",server="0",stream="hello"} 9
+` + hlsClients + `# HELP nginx_rtmp_application_clients Current number of clients connected to the application
+# TYPE nginx_rtmp_application_clients gauge
+nginx_rtmp_application_clients{application="stream",role="publisher",server="0"} 1
+nginx_rtmp_application_clients{application="stream",role="player",server="0"} 1
+nginx_rtmp_application_clients{application="hls",role="publisher",server="0"} 5
+nginx_rtmp_application_clients{application="hls",role="player",server="0"} 0
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := readStats(t)
+			if test.edit != nil {
+				page = test.edit(page)
+			}
+			compareMetrics(t, page, nil, test.expected, "nginx_rtmp_stream_clients", "nginx_rtmp_application_clients")
+		})
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	compareMetrics(t, readStats(t), nil, `
+# HELP nginx_rtmp_server_accepted_connections_total Number of connections accepted by NGINX-RTMP
+# TYPE nginx_rtmp_server_accepted_connections_total counter
+nginx_rtmp_server_accepted_connections_total 7
+# HELP nginx_rtmp_server_info NGINX and NGINX-RTMP build information
+# TYPE nginx_rtmp_server_info gauge
+nginx_rtmp_server_info{built="Oct 26 2019 05:15:38",compiler="gcc 6.4.0 (Alpine 6.4.0)",nginx_rtmp_version="1.1.4",nginx_version="1.16.1"} 1
+`, "nginx_rtmp_server_accepted_connections_total", "nginx_rtmp_server_info")
+}
+
+func TestApplicationMetrics(t *testing.T) {
+	compareMetrics(t, readStats(t), nil, `
+# HELP nginx_rtmp_application_incoming_bytes_total Current total of incoming bytes of the application streams
+# TYPE nginx_rtmp_application_incoming_bytes_total counter
+nginx_rtmp_application_incoming_bytes_total{application="stream",server="0"} 20908965
+nginx_rtmp_application_incoming_bytes_total{application="hls",server="0"} 72064682
+# HELP nginx_rtmp_application_receive_bytes Current bandwidth in of the application streams per second
+# TYPE nginx_rtmp_application_receive_bytes gauge
+nginx_rtmp_application_receive_bytes{application="stream",server="0"} 1.4703521728515625
+nginx_rtmp_application_receive_bytes{application="hls",server="0"} 5.1076812744140625
+# HELP nginx_rtmp_application_current_streams Current number of active streams of the application
+# TYPE nginx_rtmp_application_current_streams gauge
+nginx_rtmp_application_current_streams{application="stream",server="0"} 1
+nginx_rtmp_application_current_streams{application="hls",server="0"} 5
+# HELP nginx_rtmp_server_block_incoming_bytes_total Current total of incoming bytes of the server block streams
+# TYPE nginx_rtmp_server_block_incoming_bytes_total counter
+nginx_rtmp_server_block_incoming_bytes_total{server="0"} 92973647
+# HELP nginx_rtmp_server_block_receive_bytes Current bandwidth in of the server block streams per second
+# TYPE nginx_rtmp_server_block_receive_bytes gauge
+nginx_rtmp_server_block_receive_bytes{server="0"} 6.578033447265625
+# HELP nginx_rtmp_server_block_current_streams Current number of active streams of the server block
+# TYPE nginx_rtmp_server_block_current_streams gauge
+nginx_rtmp_server_block_current_streams{server="0"} 6
+`, "nginx_rtmp_application_incoming_bytes_total", "nginx_rtmp_application_receive_bytes", "nginx_rtmp_application_current_streams",
+		"nginx_rtmp_server_block_incoming_bytes_total", "nginx_rtmp_server_block_receive_bytes", "nginx_rtmp_server_block_current_streams")
+
+	// A missing value is left out of the totals
+	page := bytes.Replace(readStats(t), []byte("<bytes_in>37037244</bytes_in>"), nil, 1)
+	compareMetrics(t, page, nil, `
+# HELP nginx_rtmp_application_incoming_bytes_total Current total of incoming bytes of the application streams
+# TYPE nginx_rtmp_application_incoming_bytes_total counter
+nginx_rtmp_application_incoming_bytes_total{application="stream",server="0"} 20908965
+nginx_rtmp_application_incoming_bytes_total{application="hls",server="0"} 35027438
+# HELP nginx_rtmp_server_block_incoming_bytes_total Current total of incoming bytes of the server block streams
+# TYPE nginx_rtmp_server_block_incoming_bytes_total counter
+nginx_rtmp_server_block_incoming_bytes_total{server="0"} 55936403
+`, "nginx_rtmp_application_incoming_bytes_total", "nginx_rtmp_server_block_incoming_bytes_total")
+}
+
+func TestBandwidthNaming(t *testing.T) {
+	tests := []struct {
+		naming   string
+		expected string
+		names    []string
+	}{
+		{
+			naming: LegacyNaming,
+			expected: `
+# HELP nginx_rtmp_server_receive_bytes Current bandwidth in per second
+# TYPE nginx_rtmp_server_receive_bytes gauge
+nginx_rtmp_server_receive_bytes 6.615821838378906
+# HELP nginx_rtmp_server_transmit_bytes Current bandwidth out per second
+# TYPE nginx_rtmp_server_transmit_bytes gauge
+nginx_rtmp_server_transmit_bytes 1.4683074951171875
+`,
+			names: []string{"nginx_rtmp_server_receive_bytes", "nginx_rtmp_server_transmit_bytes", "nginx_rtmp_server_receive_bytes_per_second"},
+		},
+		{
+			naming: V2Naming,
+			expected: `
+# HELP nginx_rtmp_server_receive_bytes_per_second Current bandwidth in, in bytes per second
+# TYPE nginx_rtmp_server_receive_bytes_per_second gauge
+nginx_rtmp_server_receive_bytes_per_second 867149
+# HELP nginx_rtmp_server_transmit_bytes_per_second Current bandwidth out, in bytes per second
+# TYPE nginx_rtmp_server_transmit_bytes_per_second gauge
+nginx_rtmp_server_transmit_bytes_per_second 192454
+`,
+			names: []string{"nginx_rtmp_server_receive_bytes_per_second", "nginx_rtmp_server_transmit_bytes_per_second", "nginx_rtmp_server_receive_bytes"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.naming, func(t *testing.T) {
+			compareMetrics(t, readStats(t), []Option{WithNaming(test.naming)}, test.expected, test.names...)
+		})
+	}
+
+	// The audio and video bandwidth has no legacy name, so it is only exported
+	// with v2
+	compareMetrics(t, readStats(t), []Option{WithNaming(LegacyNaming)}, "",
+		"nginx_rtmp_stream_video_receive_bytes", "nginx_rtmp_stream_video_receive_bytes_per_second",
+		"nginx_rtmp_stream_audio_receive_bytes", "nginx_rtmp_stream_audio_receive_bytes_per_second")
+	compareMetrics(t, readStats(t), []Option{WithNaming(V2Naming)}, `
+# HELP nginx_rtmp_stream_video_receive_bytes_per_second Current video bandwidth in, in bytes per second
+# TYPE nginx_rtmp_stream_video_receive_bytes_per_second gauge
+nginx_rtmp_stream_video_receive_bytes_per_second{application="stream",server="0",stream="hello"} 192722
+nginx_rtmp_stream_video_receive_bytes_per_second{application="hls",server="0",stream="hello_360p878kbs"} 103387
+nginx_rtmp_stream_video_receive_bytes_per_second{application="hls",server="0",stream="hello_240p264kbs"} 27858
+nginx_rtmp_stream_video_receive_bytes_per_second{application="hls",server="0",stream="hello_240p528kbs"} 55498
+nginx_rtmp_stream_video_receive_bytes_per_second{application="hls",server="0",stream="hello_720p2628kbs"} 345084
+nginx_rtmp_stream_video_receive_bytes_per_second{application="hls",server="0",stream="hello_480p1128kbs"} 137647
+`, "nginx_rtmp_stream_video_receive_bytes_per_second", "nginx_rtmp_stream_video_receive_bytes")
+}
+
+func TestParsing(t *testing.T) {
+	page := bytes.Replace(readStats(t), []byte("<bw_in>1101176</bw_in>"), nil, 1)
+	names := []string{"nginx_rtmp_up", "nginx_rtmp_parse_errors_total", "nginx_rtmp_scrape_errors_total", "nginx_rtmp_stream_receive_bytes"}
+
+	t.Run("tolerant", func(t *testing.T) {
+		// Only the bandwidth of the stream without <bw_in> is missing
+		compareMetrics(t, page, nil, `
+# HELP nginx_rtmp_up Was the last scrape of NGINX-RTMP successful
+# TYPE nginx_rtmp_up gauge
+nginx_rtmp_up 1
+# HELP nginx_rtmp_parse_errors_total Number of missing or malformed elements skipped in the stats document, by element
+# TYPE nginx_rtmp_parse_errors_total counter
+nginx_rtmp_parse_errors_total{element="stream/bw_in"} 1
+# HELP nginx_rtmp_scrape_errors_total Number of errors while scraping NGINX-RTMP, by stage
+# TYPE nginx_rtmp_scrape_errors_total counter
+nginx_rtmp_scrape_errors_total{stage="extract"} 0
+nginx_rtmp_scrape_errors_total{stage="fetch"} 0
+nginx_rtmp_scrape_errors_total{stage="http_status"} 0
+nginx_rtmp_scrape_errors_total{stage="parse"} 0
+# HELP nginx_rtmp_stream_receive_bytes Current bandwidth in per second
+# TYPE nginx_rtmp_stream_receive_bytes gauge
+nginx_rtmp_stream_receive_bytes{application="stream",server="0",stream="hello"} 1.4703521728515625
+nginx_rtmp_stream_receive_bytes{application="hls",server="0",stream="hello_240p264kbs"} 0.2125396728515625
+nginx_rtmp_stream_receive_bytes{application="hls",server="0",stream="hello_240p528kbs"} 0.4234161376953125
+nginx_rtmp_stream_receive_bytes{application="hls",server="0",stream="hello_360p878kbs"} 0.7887802124023438
+nginx_rtmp_stream_receive_bytes{application="hls",server="0",stream="hello_720p2628kbs"} 2.632781982421875
+`, names...)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		// The streams decoded before the one without <bw_in> are dropped too
+		compareMetrics(t, page, []Option{WithStrictParsing()}, `
+# HELP nginx_rtmp_up Was the last scrape of NGINX-RTMP successful
+# TYPE nginx_rtmp_up gauge
+nginx_rtmp_up 0
+# HELP nginx_rtmp_parse_errors_total Number of missing or malformed elements skipped in the stats document, by element
+# TYPE nginx_rtmp_parse_errors_total counter
+nginx_rtmp_parse_errors_total{element="stream/bw_in"} 1
+# HELP nginx_rtmp_scrape_errors_total Number of errors while scraping NGINX-RTMP, by stage
+# TYPE nginx_rtmp_scrape_errors_total counter
+nginx_rtmp_scrape_errors_total{stage="extract"} 1
+nginx_rtmp_scrape_errors_total{stage="fetch"} 0
+nginx_rtmp_scrape_errors_total{stage="http_status"} 0
+nginx_rtmp_scrape_errors_total{stage="parse"} 0
+`, names...)
+	})
+
+	// Play sections have no counters, and empty avsync elements are
+	// written when audio and video are interleaved
+	play := bytes.Replace(readStats(t), []byte("</live>"), []byte(`</live>
+      <play>
+        <stream>
+          <name>vod.mp4</name>
+          <client>
+            <id>7</id>
+            <address>203.0.113.9</address>
+            <time>4500</time>
+            <flashver>LNX 9,0,124,2</flashver>
+            <active />
+          </client>
+          <active />
+          <nclients>1</nclients>
+        </stream>
+        <nclients>1</nclients>
+      </play>`), 1)
+	play = bytes.Replace(play, []byte("<avsync>-118900</avsync>"), []byte("<avsync></avsync>"), 1)
+	for name, opts := range map[string][]Option{"tolerant play": nil, "strict play": {WithStrictParsing()}} {
+		t.Run(name, func(t *testing.T) {
+			compareMetrics(t, play, append(opts, WithCollectors(ClientsCollector)), `
+# HELP nginx_rtmp_up Was the last scrape of NGINX-RTMP successful
+# TYPE nginx_rtmp_up gauge
+nginx_rtmp_up 1
+# HELP nginx_rtmp_client_avsync_seconds Difference between audio and video timestamps of the client
+# TYPE nginx_rtmp_client_avsync_seconds gauge
+nginx_rtmp_client_avsync_seconds{address="127.0.0.1",application="hls",id="4",role="publisher",server="0",stream="hello_720p2628kbs"} -117.533
+nginx_rtmp_client_avsync_seconds{address="127.0.0.1",application="hls",id="5",role="publisher",server="0",stream="hello_480p1128kbs"} -117.533
+nginx_rtmp_client_avsync_seconds{address="127.0.0.1",application="hls",id="6",role="publisher",server="0",stream="hello_360p878kbs"} -117.533
+nginx_rtmp_client_avsync_seconds{address="127.0.0.1",application="hls",id="7",role="publisher",server="0",stream="hello_240p528kbs"} -117.533
+nginx_rtmp_client_avsync_seconds{address="127.0.0.1",application="hls",id="8",role="publisher",server="0",stream="hello_240p264kbs"} -117.333
+nginx_rtmp_client_avsync_seconds{address="172.17.0.1",application="stream",id="1",role="publisher",server="0",stream="hello"} -118.9
+`, "nginx_rtmp_up", "nginx_rtmp_parse_errors_total", "nginx_rtmp_client_avsync_seconds")
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/rtmpstat"
+)
+
+// streamKey identifies a stream from scrape to scrape
+type streamKey struct {
+	server      int
+	application string
+	section     string
+	name        string
+}
+
+// streamState is what is known of a stream from the previous scrapes
+type streamState struct {
+	seen          time.Time // when it was seen first
+	uptime        float64   // in seconds, as of the last scrape
+	bytesIn       float64   // as of the last scrape
+	reconnects    float64
+	lastReconnect time.Time
+	publishing    bool
+	lastIngest    time.Time // when its incoming bytes last grew
+	stalled       bool
+	stalls        float64
+}
+
+// lifecycle follows the streams from scrape to scrape, to count the streams
+// started, stopped, reconnected and stalled in between
+type lifecycle struct {
+	mutex       sync.Mutex
+	streams     map[streamKey]*streamState // nil before the first scrape
+	stallWindow time.Duration
+
+	starts    *prometheus.CounterVec
+	stops     *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+func newLifecycle(stallWindow time.Duration, constLabels prometheus.Labels) *lifecycle {
+	return &lifecycle{
+		stallWindow: stallWindow,
+		starts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "stream_starts_total",
+			Help:        "Number of streams started between scrapes, by application",
+			ConstLabels: constLabels,
+		}, applicationLabels),
+		stops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "stream_stops_total",
+			Help:        "Number of streams stopped between scrapes, by application",
+			ConstLabels: constLabels,
+		}, applicationLabels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "stream_session_duration_seconds",
+			Help:        "Duration of the stopped streams, by application",
+			Buckets:     []float64{10, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400},
+			ConstLabels: constLabels,
+		}, applicationLabels),
+	}
+}
+
+// update compares the streams of a scrape with the ones of the previous
+// scrape. The streams of the first scrape are not counted as started.
+func (l *lifecycle) update(streams map[streamKey]rtmpstat.Stream, logger log.Logger) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	first := l.streams == nil
+	current := make(map[streamKey]*streamState, len(streams))
+	for key, stream := range streams {
+		labels := []string{strconv.Itoa(key.server), key.application}
+		// The counters of the application are exported from 0, for rate() to see its first stream
+		starts := l.starts.WithLabelValues(labels...)
+		l.stops.WithLabelValues(labels...)
+		state, ok := l.streams[key]
+		progressed := !ok || stream.BytesIn != state.bytesIn // missing values always differ
+		switch {
+		case !ok:
+			state = &streamState{seen: now}
+			if !first {
+				starts.Inc()
+				level.Info(logger).Log("msg", "Stream started", "server", key.server, "application", key.application, "section", key.section, "stream", key.name)
+			}
+		case stream.Time < state.uptime || stream.BytesIn < state.bytesIn:
+			// The publisher reconnected under the same name, missing values never compare
+			state.reconnects++
+			state.lastReconnect = now
+			level.Info(logger).Log("msg", "Stream reconnected", "server", key.server, "application", key.application, "section", key.section, "stream", key.name, "uptime", stream.Time)
+		}
+		l.checkStall(key, state, stream.Publishing, progressed, now, logger)
+		state.uptime = stream.Time
+		state.bytesIn = stream.BytesIn
+		current[key] = state
+	}
+	for key, state := range l.streams {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		// The stream may have gone on for up to a scrape interval
+		duration := state.uptime
+		if math.IsNaN(duration) {
+			duration = now.Sub(state.seen).Seconds()
+		}
+		labels := []string{strconv.Itoa(key.server), key.application}
+		l.stops.WithLabelValues(labels...).Inc()
+		l.durations.WithLabelValues(labels...).Observe(duration)
+		level.Info(logger).Log("msg", "Stream stopped", "server", key.server, "application", key.application, "section", key.section, "stream", key.name, "duration", duration)
+	}
+	l.streams = current
+}
+
+// checkStall reports a publishing stream as stalled once its incoming bytes
+// didn't grow for the stall window, and as resumed when they grow again
+func (l *lifecycle) checkStall(key streamKey, state *streamState, publishing, progressed bool, now time.Time, logger log.Logger) {
+	if l.stallWindow <= 0 {
+		return
+	}
+	state.publishing = publishing
+	if !publishing || progressed {
+		if state.stalled {
+			level.Info(logger).Log("msg", "Stream resumed", "server", key.server, "application", key.application, "section", key.section, "stream", key.name, "stalled_for", now.Sub(state.lastIngest).Seconds())
+		}
+		state.stalled = false
+		state.lastIngest = now
+		return
+	}
+	if !state.stalled && now.Sub(state.lastIngest) >= l.stallWindow {
+		state.stalled = true
+		state.stalls++
+		level.Warn(logger).Log("msg", "Stream stalled", "server", key.server, "application", key.application, "section", key.section, "stream", key.name, "stalled_for", now.Sub(state.lastIngest).Seconds())
+	}
+}
+
+func (l *lifecycle) Describe(ch chan<- *prometheus.Desc) {
+	l.starts.Describe(ch)
+	l.stops.Describe(ch)
+	l.durations.Describe(ch)
+}
+
+func (l *lifecycle) Collect(ch chan<- prometheus.Metric) {
+	l.starts.Collect(ch)
+	l.stops.Collect(ch)
+	l.durations.Collect(ch)
+}
+
+// sendStreamStates sends the reconnects and stalls of the streams exported by
+// the last scrape, along with its other metrics
+func (c *Collector) sendStreamStates(send func(prometheus.Metric), exported map[streamKey][]string) {
+	l := c.lifecycle
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, labels := range exported {
+		state, ok := l.streams[key]
+		if !ok {
+			continue
+		}
+		send(prometheus.MustNewConstMetric(c.streamMetrics["reconnects"], prometheus.CounterValue, state.reconnects, labels...))
+		if !state.lastReconnect.IsZero() {
+			send(prometheus.MustNewConstMetric(c.streamMetrics["lastReconnect"], prometheus.GaugeValue, float64(state.lastReconnect.UnixNano())/1e9, labels...))
+		}
+		if l.stallWindow <= 0 || !state.publishing {
+			continue
+		}
+		stalled, stallDuration := 0.0, 0.0
+		if state.stalled {
+			stalled, stallDuration = 1, now.Sub(state.lastIngest).Seconds()
+		}
+		send(prometheus.MustNewConstMetric(c.streamMetrics["stalled"], prometheus.GaugeValue, stalled, labels...))
+		send(prometheus.MustNewConstMetric(c.streamMetrics["stalls"], prometheus.CounterValue, state.stalls, labels...))
+		send(prometheus.MustNewConstMetric(c.streamMetrics["stallDuration"], prometheus.GaugeValue, stallDuration, labels...))
+	}
+}
@@ -0,0 +1,208 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/rtmpstat"
+)
+
+var (
+	helloKey = streamKey{server: 0, application: "live", section: "live", name: "hello"}
+	worldKey = streamKey{server: 0, application: "live", section: "live", name: "world"}
+)
+
+// stream returns a stream with the values compared by the lifecycle
+func stream(uptime, bytesIn float64, publishing bool) rtmpstat.Stream {
+	return rtmpstat.Stream{Time: uptime, BytesIn: bytesIn, Publishing: publishing}
+}
+
+// metricValue returns the value of a counter, or the sample count and sum of a
+// histogram
+func metricValue(t *testing.T, m prometheus.Metric) (float64, float64) {
+	t.Helper()
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	if h := pb.GetHistogram(); h != nil {
+		return float64(h.GetSampleCount()), h.GetSampleSum()
+	}
+	return pb.GetCounter().GetValue(), 0
+}
+
+func TestLifecycleStarts(t *testing.T) {
+	l := newLifecycle(0, nil)
+	l.update(map[streamKey]rtmpstat.Stream{helloKey: stream(10, 100, true)}, log.NewNopLogger())
+	if starts, _ := metricValue(t, l.starts.WithLabelValues("0", "live")); starts != 0 {
+		t.Errorf("starts after the first scrape = %v, want 0", starts)
+	}
+
+	l.update(map[streamKey]rtmpstat.Stream{
+		helloKey: stream(20, 200, true),
+		worldKey: stream(5, 50, true),
+	}, log.NewNopLogger())
+	if starts, _ := metricValue(t, l.starts.WithLabelValues("0", "live")); starts != 1 {
+		t.Errorf("starts after a new stream = %v, want 1", starts)
+	}
+	if stops, _ := metricValue(t, l.stops.WithLabelValues("0", "live")); stops != 0 {
+		t.Errorf("stops = %v, want 0", stops)
+	}
+}
+
+func TestLifecycleReconnects(t *testing.T) {
+	tests := []struct {
+		name       string
+		streams    []rtmpstat.Stream
+		reconnects float64
+	}{
+		{"growing", []rtmpstat.Stream{stream(10, 100, true), stream(20, 200, true)}, 0},
+		{"time drop", []rtmpstat.Stream{stream(10, 100, true), stream(5, 200, true)}, 1},
+		{"bytes_in drop", []rtmpstat.Stream{stream(10, 100, true), stream(20, 50, true)}, 1},
+		{"both drop", []rtmpstat.Stream{stream(10, 100, true), stream(5, 50, true)}, 1},
+		{"every scrape", []rtmpstat.Stream{stream(10, 100, true), stream(5, 50, true), stream(1, 10, true)}, 2},
+		{"missing time", []rtmpstat.Stream{stream(10, 100, true), stream(math.NaN(), 200, true), stream(5, 300, true)}, 0},
+		{"missing bytes_in", []rtmpstat.Stream{stream(10, 100, true), stream(20, math.NaN(), true), stream(30, 50, true)}, 0},
+		{"missing everything", []rtmpstat.Stream{stream(math.NaN(), math.NaN(), true), stream(math.NaN(), math.NaN(), true)}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLifecycle(0, nil)
+			for _, s := range test.streams {
+				l.update(map[streamKey]rtmpstat.Stream{helloKey: s}, log.NewNopLogger())
+			}
+			state := l.streams[helloKey]
+			if state.reconnects != test.reconnects {
+				t.Errorf("reconnects = %v, want %v", state.reconnects, test.reconnects)
+			}
+			if state.lastReconnect.IsZero() != (test.reconnects == 0) {
+				t.Errorf("last reconnect = %v with %v reconnects", state.lastReconnect, test.reconnects)
+			}
+		})
+	}
+}
+
+func TestLifecycleStalls(t *testing.T) {
+	l := newLifecycle(time.Minute, nil)
+	scrape := func(s rtmpstat.Stream) *streamState {
+		l.update(map[streamKey]rtmpstat.Stream{helloKey: s}, log.NewNopLogger())
+		return l.streams[helloKey]
+	}
+
+	state := scrape(stream(10, 100, true))
+	if state.stalled {
+		t.Fatal("stalled on the first scrape")
+	}
+	state = scrape(stream(20, 100, true))
+	if state.stalled {
+		t.Fatal("stalled before the stall window")
+	}
+
+	state.lastIngest = time.Now().Add(-2 * time.Minute)
+	state = scrape(stream(30, 100, true))
+	if !state.stalled || state.stalls != 1 {
+		t.Fatalf("stalled = %v with %v stalls after the stall window, want true with 1", state.stalled, state.stalls)
+	}
+	state = scrape(stream(40, 100, true))
+	if !state.stalled || state.stalls != 1 {
+		t.Fatalf("stalled = %v with %v stalls during the stall, want true with 1", state.stalled, state.stalls)
+	}
+
+	state = scrape(stream(50, 200, true))
+	if state.stalled || state.stalls != 1 {
+		t.Fatalf("stalled = %v with %v stalls once bytes_in grew, want false with 1", state.stalled, state.stalls)
+	}
+	if time.Since(state.lastIngest) > time.Minute {
+		t.Errorf("last ingest = %v, want the last scrape", state.lastIngest)
+	}
+
+	// Missing values and streams without a publisher never stall
+	for _, s := range []rtmpstat.Stream{stream(60, math.NaN(), true), stream(70, 200, false)} {
+		state.lastIngest = time.Now().Add(-2 * time.Minute)
+		state = scrape(s)
+		state = scrape(s)
+		if state.stalled || state.stalls != 1 {
+			t.Errorf("stalled = %v with %v stalls for %+v, want false with 1", state.stalled, state.stalls, s)
+		}
+	}
+}
+
+func TestLifecycleStops(t *testing.T) {
+	l := newLifecycle(0, nil)
+	l.update(map[streamKey]rtmpstat.Stream{
+		helloKey: stream(120, 100, true),
+		worldKey: stream(math.NaN(), 100, true),
+	}, log.NewNopLogger())
+	// The stream without an uptime was seen first 90 seconds ago
+	l.streams[worldKey].seen = time.Now().Add(-90 * time.Second)
+
+	l.update(map[streamKey]rtmpstat.Stream{}, log.NewNopLogger())
+	if stops, _ := metricValue(t, l.stops.WithLabelValues("0", "live")); stops != 2 {
+		t.Errorf("stops = %v, want 2", stops)
+	}
+	count, sum := metricValue(t, l.durations.WithLabelValues("0", "live").(prometheus.Metric))
+	if count != 2 {
+		t.Fatalf("durations observed = %v, want 2", count)
+	}
+	// 120 seconds of uptime, and about 90 seconds since it was seen
+	if sum < 209 || sum > 211 {
+		t.Errorf("sum of the durations = %v, want about 210", sum)
+	}
+	if len(l.streams) != 0 {
+		t.Errorf("streams = %v, want none", l.streams)
+	}
+}
+
+func TestLifecycleWithoutApplications(t *testing.T) {
+	pages := [][]byte{readStats(t), bytes.Replace(readStats(t), []byte("<name>hello</name>"), []byte("<name>world</name>"), 1)}
+	var scrapes int
+	fetcher := FetcherFunc(func(context.Context) (io.ReadCloser, error) {
+		page := pages[min(scrapes, len(pages)-1)]
+		scrapes++
+		return io.NopCloser(bytes.NewReader(page)), nil
+	})
+	c, err := New(WithFetcher(fetcher), WithCollectors(StreamsCollector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCount(c)
+
+	// The start of world and the stop of hello are exported, and described,
+	// without the applications collector
+	for _, name := range []string{"nginx_rtmp_stream_starts_total", "nginx_rtmp_stream_stops_total", "nginx_rtmp_stream_session_duration_seconds"} {
+		if got := testutil.CollectAndCount(c, name); got == 0 {
+			t.Errorf("no %s series", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newExporterMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", metricName), docString, varLabels, constLabels)
+}
+
+func newServerMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "server", metricName), docString, varLabels, constLabels)
+}
+
+func newStreamMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "stream", metricName), docString, varLabels, constLabels)
+}
+
+func newApplicationMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "application", metricName), docString, varLabels, constLabels)
+}
+
+func newServerBlockMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "server_block", metricName), docString, varLabels, constLabels)
+}
+
+func newClientMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "client", metricName), docString, varLabels, constLabels)
+}
+
+type metricBuilder func(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc
+
+// newBandwidthMetric builds a bandwidth metric named after the naming scheme.
+// The legacy scheme exports mebibits per second under a "_bytes" suffix, v2
+// exports bytes per second.
+func newBandwidthMetric(build metricBuilder, naming string, metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	if naming == V2Naming {
+		return build(metricName+"_bytes_per_second", docString+", in bytes per second", varLabels, constLabels)
+	}
+	return build(metricName+"_bytes", docString+" per second", varLabels, constLabels)
+}
+
+type metrics map[string]*prometheus.Desc
+
+var (
+	streamLabels       = []string{"server", "application", "stream"}
+	legacyStreamLabels = []string{"stream"}
+	applicationLabels  = []string{"server", "application"}
+	clientLabels       = []string{"server", "application", "stream", "role", "address", "id"}
+)
+
+// newServerMetrics builds the server metrics for the naming scheme
+func newServerMetrics(naming string, constLabels prometheus.Labels) metrics {
+	return metrics{
+		"bytesIn":        newServerMetric("incoming_bytes_total", "Current total of incoming bytes", nil, constLabels),
+		"bytesOut":       newServerMetric("outgoing_bytes_total", "Current total of outgoing bytes", nil, constLabels),
+		"bandwidthIn":    newBandwidthMetric(newServerMetric, naming, "receive", "Current bandwidth in", nil, constLabels),
+		"bandwidthOut":   newBandwidthMetric(newServerMetric, naming, "transmit", "Current bandwidth out", nil, constLabels),
+		"currentStreams": newServerMetric("current_streams", "Current number of active streams", nil, constLabels),
+		"uptime":         newServerMetric("uptime_seconds_total", "Number of seconds NGINX-RTMP started", nil, constLabels),
+		"accepted":       newServerMetric("accepted_connections_total", "Number of connections accepted by NGINX-RTMP", nil, constLabels),
+		"info":           newServerMetric("info", "NGINX and NGINX-RTMP build information", []string{"nginx_version", "nginx_rtmp_version", "compiler", "built"}, constLabels),
+	}
+}
+
+// newApplicationMetrics builds the application metrics for the naming scheme
+func newApplicationMetrics(naming string, constLabels prometheus.Labels) metrics {
+	return metrics{
+		"bytesIn":        newApplicationMetric("incoming_bytes_total", "Current total of incoming bytes of the application streams", applicationLabels, constLabels),
+		"bytesOut":       newApplicationMetric("outgoing_bytes_total", "Current total of outgoing bytes of the application streams", applicationLabels, constLabels),
+		"bandwidthIn":    newBandwidthMetric(newApplicationMetric, naming, "receive", "Current bandwidth in of the application streams", applicationLabels, constLabels),
+		"bandwidthOut":   newBandwidthMetric(newApplicationMetric, naming, "transmit", "Current bandwidth out of the application streams", applicationLabels, constLabels),
+		"currentStreams": newApplicationMetric("current_streams", "Current number of active streams of the application", applicationLabels, constLabels),
+		"clients":        newApplicationMetric("clients", "Current number of clients connected to the application", withLabels(applicationLabels, "role"), constLabels),
+	}
+}
+
+// newServerBlockMetrics builds the server block metrics for the naming scheme
+func newServerBlockMetrics(naming string, constLabels prometheus.Labels) metrics {
+	return metrics{
+		"bytesIn":        newServerBlockMetric("incoming_bytes_total", "Current total of incoming bytes of the server block streams", []string{"server"}, constLabels),
+		"bytesOut":       newServerBlockMetric("outgoing_bytes_total", "Current total of outgoing bytes of the server block streams", []string{"server"}, constLabels),
+		"bandwidthIn":    newBandwidthMetric(newServerBlockMetric, naming, "receive", "Current bandwidth in of the server block streams", []string{"server"}, constLabels),
+		"bandwidthOut":   newBandwidthMetric(newServerBlockMetric, naming, "transmit", "Current bandwidth out of the server block streams", []string{"server"}, constLabels),
+		"currentStreams": newServerBlockMetric("current_streams", "Current number of active streams of the server block", []string{"server"}, constLabels),
+		"clients":        newServerBlockMetric("clients", "Current number of clients connected to the server block", []string{"server", "role"}, constLabels),
+	}
+}
+
+// newExporterMetrics builds the metrics about the scrapes themselves
+func newExporterMetrics(constLabels prometheus.Labels) metrics {
+	return metrics{
+		"up":             newExporterMetric("up", "Was the last scrape of NGINX-RTMP successful", nil, constLabels),
+		"scrapeDuration": newExporterMetric("scrape_duration_seconds", "Duration of the last scrape of NGINX-RTMP", nil, constLabels),
+		"lastSuccess":    newExporterMetric("last_scrape_success_timestamp_seconds", "Unix timestamp of the last successful scrape of NGINX-RTMP", nil, constLabels),
+		"snapshotAge":    newExporterMetric("snapshot_age_seconds", "Age of the stats served from the last successful poll of NGINX-RTMP", nil, constLabels),
+	}
+}
+
+// newClientMetrics builds the client metrics
+func newClientMetrics(constLabels prometheus.Labels) metrics {
+	return metrics{
+		"uptime":  newClientMetric("uptime_seconds_total", "Number of seconds since the client connected", clientLabels, constLabels),
+		"dropped": newClientMetric("dropped_frames_total", "Number of frames dropped while sending to the client", clientLabels, constLabels),
+		"avsync":  newClientMetric("avsync_seconds", "Difference between audio and video timestamps of the client", clientLabels, constLabels),
+	}
+}
+
+// newStreamMetrics builds the stream metrics for the naming scheme, identifying
+// each stream by the given labels
+func newStreamMetrics(naming string, labels []string, constLabels prometheus.Labels) metrics {
+	m := metrics{
+		"bytesIn":      newStreamMetric("incoming_bytes_total", "Current total of incoming bytes", labels, constLabels),
+		"bytesOut":     newStreamMetric("outgoing_bytes_total", "Current total of outgoing bytes", labels, constLabels),
+		"bandwidthIn":  newBandwidthMetric(newStreamMetric, naming, "receive", "Current bandwidth in", labels, constLabels),
+		"bandwidthOut": newBandwidthMetric(newStreamMetric, naming, "transmit", "Current bandwidth out", labels, constLabels),
+		"uptime":       newStreamMetric("uptime_seconds_total", "Number of seconds since the stream started", labels, constLabels),
+
+		"clients": newStreamMetric("clients", "Current number of clients connected to the stream", withLabels(labels, "role"), constLabels),
+
+		"videoInfo":       newStreamMetric("video_info", "Video metadata declared by the publisher", withLabels(labels, "codec", "profile", "level"), constLabels),
+		"videoWidth":      newStreamMetric("video_width_pixels", "Video width declared by the publisher", labels, constLabels),
+		"videoHeight":     newStreamMetric("video_height_pixels", "Video height declared by the publisher", labels, constLabels),
+		"videoFrameRate":  newStreamMetric("video_frame_rate", "Video frames per second declared by the publisher", labels, constLabels),
+		"audioInfo":       newStreamMetric("audio_info", "Audio metadata declared by the publisher", withLabels(labels, "codec", "profile"), constLabels),
+		"audioChannels":   newStreamMetric("audio_channels", "Number of audio channels declared by the publisher", labels, constLabels),
+		"audioSampleRate": newStreamMetric("audio_sample_rate_hertz", "Audio sample rate declared by the publisher", labels, constLabels),
+
+		"reconnects":    newStreamMetric("reconnects_total", "Number of times the publisher reconnected between scrapes", labels, constLabels),
+		"lastReconnect": newStreamMetric("last_reconnect_timestamp_seconds", "Unix timestamp of the scrape that saw the last reconnect of the publisher", labels, constLabels),
+		"stalled":       newStreamMetric("stalled", "Whether the publisher sent nothing for the stall window", labels, constLabels),
+		"stalls":        newStreamMetric("stalls_total", "Number of times the publisher stalled", labels, constLabels),
+		"stallDuration": newStreamMetric("stall_duration_seconds", "Number of seconds since the stalled publisher last sent anything, 0 when it is not stalled", labels, constLabels),
+	}
+	// The legacy scheme has no correct name for them
+	if naming == V2Naming {
+		m["bandwidthAudio"] = newStreamMetric("audio_receive_bytes_per_second", "Current audio bandwidth in, in bytes per second", labels, constLabels)
+		m["bandwidthVideo"] = newStreamMetric("video_receive_bytes_per_second", "Current video bandwidth in, in bytes per second", labels, constLabels)
+	}
+	return m
+}
+
+// withLabels returns a copy of labels with extra labels appended
+func withLabels(labels []string, extra ...string) []string {
+	return append(append(make([]string, 0, len(labels)+len(extra)), labels...), extra...)
+}
@@ -0,0 +1,202 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a Collector
+type Option func(*Collector) error
+
+// WithFetcher sets where the stats document is fetched from
+func WithFetcher(fetcher Fetcher) Option {
+	return func(c *Collector) error {
+		c.fetcher = fetcher
+		return nil
+	}
+}
+
+// WithStreamNameNormalizer exports stream names as the first match of re,
+// instead of the whole name
+func WithStreamNameNormalizer(re *regexp.Regexp) Option {
+	return func(c *Collector) error {
+		if re == nil {
+			return errors.New("nil stream name normalizer")
+		}
+		c.streamNameNormalizer = re.FindString
+		return nil
+	}
+}
+
+// WithStreamNameFunc exports stream names as rewritten by fn
+func WithStreamNameFunc(fn func(string) string) Option {
+	return func(c *Collector) error {
+		if fn == nil {
+			return errors.New("nil stream name function")
+		}
+		c.streamNameNormalizer = fn
+		return nil
+	}
+}
+
+// WithLegacyStreamLabel identifies streams by a single stream label made of
+// the application and stream names separated by a dash, instead of
+// application and stream labels
+func WithLegacyStreamLabel() Option {
+	return func(c *Collector) error {
+		c.legacyStreamLabel = true
+		return nil
+	}
+}
+
+// WithConstLabels adds labels with fixed values to every metric, for example
+// to tell apart the collectors of several NGINX-RTMP servers
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(c *Collector) error {
+		c.constLabels = labels
+		return nil
+	}
+}
+
+// WithNaming sets the metric naming scheme, LegacyNaming (the default) or
+// V2Naming. The v2 scheme exports bandwidth in bytes per second.
+func WithNaming(naming string) Option {
+	return func(c *Collector) error {
+		if naming != LegacyNaming && naming != V2Naming {
+			return fmt.Errorf("unknown metric naming scheme %q", naming)
+		}
+		c.naming = naming
+		return nil
+	}
+}
+
+// WithLogger sets the logger of scrape errors, nothing is logged by default
+func WithLogger(logger log.Logger) Option {
+	return func(c *Collector) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithCollectors enables only the given sub-collectors. Streams, applications
+// and server blocks are enabled by default, clients are not. Server metrics
+// and the health of scrapes are always exported.
+func WithCollectors(names ...string) Option {
+	return func(c *Collector) error {
+		collectors := make(map[string]bool, len(names))
+		for _, name := range names {
+			switch name {
+			case StreamsCollector, ApplicationsCollector, ServerBlocksCollector, ClientsCollector:
+				collectors[name] = true
+			default:
+				return fmt.Errorf("unknown collector %q", name)
+			}
+		}
+		c.collectors = collectors
+		return nil
+	}
+}
+
+// WithMaxClientsPerStream limits the players exported per stream by the
+// clients collector, 0 means no limit. Publishers are always exported. The
+// default is 100.
+func WithMaxClientsPerStream(max int) Option {
+	return func(c *Collector) error {
+		if max < 0 {
+			return fmt.Errorf("negative maximum of clients per stream %d", max)
+		}
+		c.maxClientsPerStream = max
+		return nil
+	}
+}
+
+// WithStrictParsing fails the whole scrape when an element of the stats
+// document is missing or malformed, instead of skipping it
+func WithStrictParsing() Option {
+	return func(c *Collector) error {
+		c.strictParsing = true
+		return nil
+	}
+}
+
+// WithTimeout bounds each scrape, and the wait of collects for the scrape in
+// flight, by timeout. There is no bound by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Collector) error {
+		if timeout < 0 {
+			return fmt.Errorf("negative timeout %s", timeout)
+		}
+		c.timeout = timeout
+		return nil
+	}
+}
+
+// WithPolling scrapes NGINX-RTMP in the background every interval, see Run.
+// Collect serves the metrics of the last successful poll while they are not
+// older than maxStaleness, 0 means no limit. A limit shorter than the interval
+// would drop the metrics between polls, so it is rejected.
+func WithPolling(interval, maxStaleness time.Duration) Option {
+	return func(c *Collector) error {
+		if interval <= 0 {
+			return fmt.Errorf("non-positive poll interval %s", interval)
+		}
+		if maxStaleness < 0 {
+			return fmt.Errorf("negative max staleness %s", maxStaleness)
+		}
+		if maxStaleness > 0 && maxStaleness < interval {
+			return fmt.Errorf("max staleness %s shorter than the poll interval %s", maxStaleness, interval)
+		}
+		c.pollInterval = interval
+		c.maxStaleness = maxStaleness
+		return nil
+	}
+}
+
+// WithoutLifecycle doesn't follow the streams from scrape to scrape, for
+// collectors that are scraped once. Their starts, stops, reconnects and
+// stalls are not exported.
+func WithoutLifecycle() Option {
+	return func(c *Collector) error {
+		c.withoutLifecycle = true
+		return nil
+	}
+}
+
+// WithStallWindow reports the publishers that sent nothing for window as
+// stalled. Stalls are not detected by default.
+func WithStallWindow(window time.Duration) Option {
+	return func(c *Collector) error {
+		if window < 0 {
+			return fmt.Errorf("negative stall window %s", window)
+		}
+		c.stallWindow = window
+		return nil
+	}
+}
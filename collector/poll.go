@@ -0,0 +1,88 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the metrics of a successful poll
+type snapshot struct {
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+// Run polls NGINX-RTMP until ctx is done, when the collector was created
+// WithPolling. A poll in flight when ctx is done is not interrupted. Without
+// polling, Run returns immediately, as every collect scrapes.
+func (c *Collector) Run(ctx context.Context) {
+	if c.pollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		c.poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll scrapes NGINX-RTMP, keeping the metrics when the scrape is successful.
+// The mutex is only held to swap the snapshot, collects don't wait for the scrape.
+func (c *Collector) poll() {
+	ctx, cancel := c.scrapeContext(context.Background())
+	defer cancel()
+	var metrics []prometheus.Metric
+	result := c.observe(ctx, func(m prometheus.Metric) { metrics = append(metrics, m) })
+	c.record(result)
+	if result.ok {
+		c.mutex.Lock()
+		c.snapshot = &snapshot{metrics: metrics, time: time.Now()}
+		c.mutex.Unlock()
+	}
+}
+
+// collectSnapshot sends the metrics of the last successful poll, unless they
+// are stale
+func (c *Collector) collectSnapshot(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.snapshot != nil {
+		age := time.Since(c.snapshot.time)
+		ch <- prometheus.MustNewConstMetric(c.exporterMetrics["snapshotAge"], prometheus.GaugeValue, age.Seconds())
+		if c.maxStaleness == 0 || age <= c.maxStaleness {
+			for _, m := range c.snapshot.metrics {
+				ch <- m
+			}
+		}
+	}
+	c.collectHealth(ch, c.health)
+}
@@ -0,0 +1,115 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingFetcher serves a stats page, or fails while told to
+type failingFetcher struct {
+	page []byte
+	fail atomic.Bool
+}
+
+func (f *failingFetcher) Fetch(context.Context) (io.ReadCloser, error) {
+	if f.fail.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return io.NopCloser(bytes.NewReader(f.page)), nil
+}
+
+func TestCollectSnapshot(t *testing.T) {
+	fetcher := &failingFetcher{page: readStats(t)}
+	c, err := New(WithFetcher(fetcher), WithPolling(time.Minute, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.poll()
+	metrics := collect(t, context.Background(), c)
+	if up(t, metrics) != 1 || len(metrics["nginx_rtmp_stream_incoming_bytes_total"]) == 0 {
+		t.Fatal("snapshot of the successful poll not served")
+	}
+
+	// The last snapshot is still served after a failed poll
+	fetcher.fail.Store(true)
+	c.poll()
+	metrics = collect(t, context.Background(), c)
+	if up(t, metrics) != 0 {
+		t.Error("failed poll reported up")
+	}
+	if len(metrics["nginx_rtmp_stream_incoming_bytes_total"]) == 0 {
+		t.Error("snapshot dropped before max staleness")
+	}
+
+	// and dropped once older than the max staleness
+	c.mutex.Lock()
+	c.snapshot.time = time.Now().Add(-2 * time.Minute)
+	c.mutex.Unlock()
+	metrics = collect(t, context.Background(), c)
+	if up(t, metrics) != 0 {
+		t.Error("failed poll reported up")
+	}
+	if n := len(metrics["nginx_rtmp_stream_incoming_bytes_total"]); n != 0 {
+		t.Errorf("stale snapshot served, %d streams", n)
+	}
+	if age := metrics["nginx_rtmp_snapshot_age_seconds"]; len(age) != 1 || age[0].GetGauge().GetValue() < 120 {
+		t.Errorf("snapshot age %v, want 120s or more", age)
+	}
+
+	// A successful poll serves a fresh snapshot again
+	fetcher.fail.Store(false)
+	c.poll()
+	metrics = collect(t, context.Background(), c)
+	if up(t, metrics) != 1 || len(metrics["nginx_rtmp_stream_incoming_bytes_total"]) == 0 {
+		t.Error("snapshot of the successful poll not served")
+	}
+}
+
+func TestWithPolling(t *testing.T) {
+	tests := []struct {
+		interval, maxStaleness time.Duration
+		invalid                bool
+	}{
+		{interval: time.Minute, maxStaleness: time.Minute},
+		{interval: time.Minute, maxStaleness: 0},
+		{interval: 2 * time.Minute, maxStaleness: time.Minute, invalid: true},
+		{interval: 0, maxStaleness: time.Minute, invalid: true},
+		{interval: time.Minute, maxStaleness: -time.Minute, invalid: true},
+	}
+	for _, test := range tests {
+		_, err := New(WithFetcher(&failingFetcher{}), WithPolling(test.interval, test.maxStaleness))
+		if test.invalid && err == nil {
+			t.Errorf("interval %s and max staleness %s accepted", test.interval, test.maxStaleness)
+		}
+		if !test.invalid && err != nil {
+			t.Errorf("interval %s and max staleness %s: %v", test.interval, test.maxStaleness, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
+)
+
+// targetLabel identifies the targets of the configuration file in their metrics
+const targetLabel = "target"
+
+// Config is the configuration file of the exporter
+type Config struct {
+	Modules map[string]*Module `yaml:"modules,omitempty"`
+	Targets []*Target          `yaml:"targets,omitempty"`
+}
+
+// Module is a set of settings to scrape NGINX-RTMP with, for the targets of
+// the /probe endpoint or of the configuration file
+type Module struct {
+	Timeout             model.Duration       `yaml:"timeout,omitempty"`
+	StreamNameRegex     string               `yaml:"stream_name_regex,omitempty"`
+	StreamNameRules     []*NameRule          `yaml:"stream_name_rules,omitempty"`
+	Labels              map[string]string    `yaml:"labels,omitempty"`
+	Collectors          []string             `yaml:"collectors,omitempty"`
+	MaxClientsPerStream *int                 `yaml:"max_clients_per_stream,omitempty"`
+	AllowLocalTargets   bool                 `yaml:"allow_local_targets,omitempty"`
+	HTTPClientConfig    collector.HTTPConfig `yaml:"http_client_config,omitempty"`
+
+	streamNameNormalizer *regexp.Regexp
+}
+
+// NameRule replaces the matches of a regex in stream names
+type NameRule struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+
+	regex *regexp.Regexp
+}
+
+// Target is an NGINX-RTMP server exported on /metrics
+type Target struct {
+	Name   string `yaml:"name"`
+	URI    string `yaml:"uri"`
+	Module Module `yaml:",inline"`
+}
+
+func newModule() Module {
+	return Module{
+		Timeout:          model.Duration(5 * time.Second),
+		StreamNameRegex:  ".*",
+		HTTPClientConfig: collector.DefaultHTTPConfig,
+	}
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (m *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = newModule()
+	type plain Module
+	if err := unmarshal((*plain)(m)); err != nil {
+		return err
+	}
+	return m.compile()
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (t *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*t = Target{Module: newModule()}
+	type plain Target
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	if t.Name == "" {
+		return errors.New("target without a name")
+	}
+	if t.URI == "" {
+		return fmt.Errorf("target %q without an uri", t.Name)
+	}
+	if err := t.Module.compile(); err != nil {
+		return fmt.Errorf("target %q: %w", t.Name, err)
+	}
+	return nil
+}
+
+// equal tells whether the targets have the same settings, ignoring the
+// compiled regexes of their modules
+func (t *Target) equal(other *Target) bool {
+	return reflect.DeepEqual(t.settings(), other.settings())
+}
+
+// settings returns a copy of the target without the compiled regexes
+func (t *Target) settings() Target {
+	settings := *t
+	settings.Module.streamNameNormalizer = nil
+	settings.Module.StreamNameRules = make([]*NameRule, len(t.Module.StreamNameRules))
+	for i, rule := range t.Module.StreamNameRules {
+		settings.Module.StreamNameRules[i] = &NameRule{Regex: rule.Regex, Replacement: rule.Replacement}
+	}
+	return settings
+}
+
+// compile checks the settings of the module, compiling its regexes
+func (m *Module) compile() error {
+	re, err := regexp.Compile(m.StreamNameRegex)
+	if err != nil {
+		return fmt.Errorf("invalid stream_name_regex: %w", err)
+	}
+	m.streamNameNormalizer = re
+	for _, rule := range m.StreamNameRules {
+		if rule == nil || rule.Regex == "" {
+			return errors.New("stream name rule without a regex")
+		}
+		if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+			return fmt.Errorf("invalid stream name rule regex: %w", err)
+		}
+	}
+	for name := range m.Labels {
+		// Other clashes with the labels of the metrics are found when registering the collectors
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") || name == targetLabel || name == model.BucketLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// normalizeStreamName rewrites a stream name with the stream name regex, then
+// with the stream name rules, in order
+func (m *Module) normalizeStreamName(name string) string {
+	if m.streamNameNormalizer != nil {
+		name = m.streamNameNormalizer.FindString(name)
+	}
+	for _, rule := range m.StreamNameRules {
+		name = rule.regex.ReplaceAllString(name, rule.Replacement)
+	}
+	return name
+}
+
+// options returns the collector options of the module, except for its fetcher
+// and labels
+func (m *Module) options() []collector.Option {
+	opts := []collector.Option{
+		collector.WithStreamNameFunc(m.normalizeStreamName),
+		collector.WithTimeout(time.Duration(m.Timeout)),
+	}
+	if m.Collectors != nil {
+		opts = append(opts, collector.WithCollectors(m.Collectors...))
+	}
+	if m.MaxClientsPerStream != nil {
+		opts = append(opts, collector.WithMaxClientsPerStream(*m.MaxClientsPerStream))
+	}
+	return opts
+}
+
+// allowsTarget tells whether /probe can scrape uri with the module. Local
+// files and sockets are only allowed by modules that say so.
+func (m *Module) allowsTarget(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	case "file", "unix":
+		if m.AllowLocalTargets {
+			return nil
+		}
+		return fmt.Errorf("%s:// targets are not allowed by the module", u.Scheme)
+	default:
+		return fmt.Errorf("unsupported scheme %q in %q", u.Scheme, uri)
+	}
+}
+
+// constLabels returns the labels of the module
+func (m *Module) constLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(m.Labels)+1)
+	for name, value := range m.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// loadConfig reads the configuration file. Relative paths in it are relative
+// to the directory of the file.
+func loadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("can't parse config file %q: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	for name, module := range cfg.Modules {
+		if module == nil {
+			return nil, fmt.Errorf("empty module %q in config file %q", name, path)
+		}
+		module.HTTPClientConfig.HTTPClientConfig.SetDirectory(dir)
+	}
+	names := make(map[string]bool, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		if target == nil {
+			return nil, fmt.Errorf("empty target in config file %q", path)
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("duplicate target %q in config file %q", target.Name, path)
+		}
+		names[target.Name] = true
+		target.Module.HTTPClientConfig.HTTPClientConfig.SetDirectory(dir)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,155 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		invalid bool
+	}{
+		{name: "empty"},
+		{name: "targets and modules", content: `
+modules:
+  edge:
+    timeout: 2s
+    labels:
+      region: eu
+targets:
+  - name: origin
+    uri: http://origin:8080/stats
+    stream_name_rules:
+      - regex: '_(\d+)p$'
+        replacement: ''
+`},
+		{name: "duplicate target", invalid: true, content: `
+targets:
+  - name: origin
+    uri: http://origin-1:8080/stats
+  - name: origin
+    uri: http://origin-2:8080/stats
+`},
+		{name: "target without a name", invalid: true, content: `
+targets:
+  - uri: http://origin:8080/stats
+`},
+		{name: "target without an uri", invalid: true, content: `
+targets:
+  - name: origin
+`},
+		{name: "empty target", invalid: true, content: `
+targets:
+  -
+`},
+		{name: "empty module", invalid: true, content: `
+modules:
+  edge:
+`},
+		{name: "invalid label name", invalid: true, content: `
+modules:
+  edge:
+    labels:
+      1region: eu
+`},
+		{name: "reserved label name", invalid: true, content: `
+modules:
+  edge:
+    labels:
+      __region: eu
+`},
+		{name: "target label", invalid: true, content: `
+targets:
+  - name: origin
+    uri: http://origin:8080/stats
+    labels:
+      target: origin
+`},
+		{name: "invalid stream name regex", invalid: true, content: `
+modules:
+  edge:
+    stream_name_regex: '('
+`},
+		{name: "invalid stream name rule regex", invalid: true, content: `
+targets:
+  - name: origin
+    uri: http://origin:8080/stats
+    stream_name_rules:
+      - regex: '[a-'
+        replacement: ''
+`},
+		{name: "stream name rule without a regex", invalid: true, content: `
+modules:
+  edge:
+    stream_name_rules:
+      - replacement: ''
+`},
+		{name: "unknown setting", invalid: true, content: `
+modules:
+  edge:
+    time_out: 2s
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(path)
+			if test.invalid && err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			if !test.invalid && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNormalizeStreamName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(`
+modules:
+  edge:
+    stream_name_regex: '^[a-z_0-9]+'
+    stream_name_rules:
+      - regex: '_(\d+)p$'
+        replacement: ''
+      - regex: '^live_'
+        replacement: 'channel_'
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Modules["edge"].normalizeStreamName("live_hello_720p-backup"); got != "channel_hello" {
+		t.Errorf("normalized to %q, want %q", got, "channel_hello")
+	}
+}
@@ -24,280 +24,57 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/alecthomas/kingpin/v2"
-	"github.com/antchfx/xmlquery"
-	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-)
-
-const (
-	namespace = "nginx_rtmp"
-)
-
-func newServerMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
-	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "server", metricName), docString, varLabels, constLabels)
-}
-
-func newStreamMetric(metricName string, docString string, varLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
-	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "stream", metricName), docString, varLabels, constLabels)
-}
-
-type metrics map[string]*prometheus.Desc
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
 
-var (
-	serverMetrics = metrics{
-		"bytesIn":        newServerMetric("incoming_bytes_total", "Current total of incoming bytes", nil, nil),
-		"bytesOut":       newServerMetric("outgoing_bytes_total", "Current total of outgoing bytes", nil, nil),
-		"bandwidthIn":    newServerMetric("receive_bytes", "Current bandwidth in per second", nil, nil),
-		"bandwidthOut":   newServerMetric("transmit_bytes", "Current bandwidth out per second", nil, nil),
-		"currentStreams": newServerMetric("current_streams", "Current number of active streams", nil, nil),
-		"uptime":         newServerMetric("uptime_seconds_total", "Number of seconds NGINX-RTMP started", nil, nil),
-	}
-	streamMetrics = metrics{
-		"bytesIn":      newStreamMetric("incoming_bytes_total", "Current total of incoming bytes", []string{"stream"}, nil),
-		"bytesOut":     newStreamMetric("outgoing_bytes_total", "Current total of outgoing bytes", []string{"stream"}, nil),
-		"bandwidthIn":  newStreamMetric("receive_bytes", "Current bandwidth in per second", []string{"stream"}, nil),
-		"bandwidthOut": newStreamMetric("transmit_bytes", "Current bandwidth out per second", []string{"stream"}, nil),
-		"uptime":       newStreamMetric("uptime_seconds_total", "Number of seconds since the stream started", []string{"stream"}, nil),
-	}
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
 )
 
-// Exporter collects NGINX-RTMP stats from the status page URI
-// using the prometheus metrics package
-type Exporter struct {
-	URI                  string
-	mutex                sync.RWMutex
-	fetch                func() (io.ReadCloser, error)
-	streamNameNormalizer *regexp.Regexp
-	logger               log.Logger
-
-	serverMetrics map[string]*prometheus.Desc
-	streamMetrics map[string]*prometheus.Desc
-}
-
-// ServerInfo characteristics of the RTMP server
-type ServerInfo struct {
-	BytesIn     float64
-	BytesOut    float64
-	BandwidthIn float64
-	BandwidhOut float64
-	Uptime      float64
-}
-
-// StreamInfo characteristics of a stream
-type StreamInfo struct {
-	Name        string
-	BytesIn     float64
-	BytesOut    float64
-	BandwidthIn float64
-	BandwidhOut float64
-	Uptime      float64
-}
-
-// NewServerInfo builds a ServerInfo struct from string values
-func NewServerInfo(bytesIn, bytesOut, bandwidthIn, bandwidthOut, uptime string) ServerInfo {
-	var bytesInNum, bytesOutNum, bandwidthInNum, bandwidthOutNum, uptimeNum float64
-	if n, err := strconv.ParseFloat(bytesIn, 64); err == nil {
-		bytesInNum = n
-	}
-	if n, err := strconv.ParseFloat(bytesOut, 64); err == nil {
-		bytesOutNum = n
-	}
-	if n, err := strconv.ParseFloat(bandwidthIn, 64); err == nil {
-		bandwidthInNum = n / 1048576 // bandwidth is in bits
-	}
-	if n, err := strconv.ParseFloat(bandwidthOut, 64); err == nil {
-		bandwidthOutNum = n / 1048576 // bandwidth is in bits
-	}
-	if n, err := strconv.ParseFloat(uptime, 64); err == nil {
-		uptimeNum = n
-	}
-	return ServerInfo{
-		BytesIn:     bytesInNum,
-		BytesOut:    bytesOutNum,
-		BandwidthIn: bandwidthInNum,
-		BandwidhOut: bandwidthOutNum,
-		Uptime:      uptimeNum,
-	}
-}
-
-// NewStreamInfo builds a StreamInfo struct from string values
-func NewStreamInfo(name, bytesIn, bytesOut, bandwidthIn, bandwidthOut, uptime string) StreamInfo {
-	var bytesInNum, bytesOutNum, bandwidthInNum, bandwidthOutNum, uptimeNum float64
-	if n, err := strconv.ParseFloat(bytesIn, 64); err == nil {
-		bytesInNum = n
-	}
-	if n, err := strconv.ParseFloat(bytesOut, 64); err == nil {
-		bytesOutNum = n
-	}
-	if n, err := strconv.ParseFloat(bandwidthIn, 64); err == nil {
-		bandwidthInNum = n / 1048576 // bandwidth is in bits
-	}
-	if n, err := strconv.ParseFloat(bandwidthOut, 64); err == nil {
-		bandwidthOutNum = n / 1048576 // bandwidth is in bits
-	}
-	if n, err := strconv.ParseFloat(uptime, 64); err == nil {
-		uptimeNum = n / 1000 // it is in miliseconds
-	}
-	return StreamInfo{
-		Name:        name,
-		BytesIn:     bytesInNum,
-		BytesOut:    bytesOutNum,
-		BandwidthIn: bandwidthInNum,
-		BandwidhOut: bandwidthOutNum,
-		Uptime:      uptimeNum,
-	}
-}
-
-// NewExporter initializes an exporter
-func NewExporter(uri string, timeout time.Duration, streamNameNormalizer *regexp.Regexp, logger log.Logger) (*Exporter, error) {
-	return &Exporter{
-		URI:                  uri,
-		fetch:                fetchStats(uri, timeout),
-		streamNameNormalizer: streamNameNormalizer,
-		logger:               logger,
-
-		serverMetrics: serverMetrics,
-		streamMetrics: streamMetrics,
-	}, nil
-}
-
-func fetchStats(uri string, timeout time.Duration) func() (io.ReadCloser, error) {
-	client := http.Client{
-		Timeout: timeout,
-	}
-
-	return func() (io.ReadCloser, error) {
-		resp, err := client.Get(uri)
-		if err != nil {
-			return nil, err
-		}
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			resp.Body.Close()
-			return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
-		}
-		return resp.Body, nil
-	}
-}
-
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.mutex.Lock() // To protect from concurrent collects
-	defer e.mutex.Unlock()
-
-	e.scrape(ch)
-}
-
-func parseServerStats(doc *xmlquery.Node) (ServerInfo, error) {
-	data := xmlquery.FindOne(doc, "//rtmp")
-
-	bytesIn := data.SelectElement("bytes_in").InnerText()
-	bytesOut := data.SelectElement("bytes_out").InnerText()
-	receiveBytes := data.SelectElement("bw_in").InnerText()
-	transmitBytes := data.SelectElement("bw_out").InnerText()
-	uptime := data.SelectElement("uptime").InnerText()
-
-	return NewServerInfo(bytesIn, bytesOut, receiveBytes, transmitBytes, uptime), nil
-}
-
-func parseStreamsStats(doc *xmlquery.Node, streamNameNormalizer *regexp.Regexp) ([]StreamInfo, error) {
-	streams := make([]StreamInfo, 0)
-	data := xmlquery.Find(doc, "//stream")
-
-	for _, stream := range data {
-		name := streamNameNormalizer.FindString(stream.SelectElement("name").InnerText())
-		// adding the app name here to ensure that the metrics are unique
-		app := ""
-		if stream.Parent != nil && stream.Parent.Parent != nil {
-			appName := stream.Parent.Parent.SelectElement("name")
-			if appName != nil {
-				app = appName.InnerText() + "-" // dash separator between app and stream names
-			}
-		}
-		bytesIn := stream.SelectElement("bytes_in").InnerText()
-		bytesOut := stream.SelectElement("bytes_out").InnerText()
-		receiveBytes := stream.SelectElement("bw_in").InnerText()
-		transmitBytes := stream.SelectElement("bw_out").InnerText()
-		uptime := stream.SelectElement("time").InnerText()
-		streams = append(streams, NewStreamInfo(app+name, bytesIn, bytesOut, receiveBytes, transmitBytes, uptime))
-	}
-	return streams, nil
-}
-
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
-	data, err := e.fetch()
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Can't scrape NGINX-RTMP", "err", err)
-		return
-	}
-	defer data.Close()
-
-	doc, err := xmlquery.Parse(data)
-	if err != nil {
-		return
-	}
-
-	server, err := parseServerStats(doc)
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Can't parse XML", "err", err)
-		return
-	}
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytesIn"], prometheus.CounterValue, server.BytesIn)
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytesOut"], prometheus.CounterValue, server.BytesOut)
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bandwidthIn"], prometheus.GaugeValue, server.BandwidthIn)
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bandwidthOut"], prometheus.GaugeValue, server.BandwidhOut)
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["uptime"], prometheus.CounterValue, server.Uptime)
-
-	streams, err := parseStreamsStats(doc, e.streamNameNormalizer)
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Can't parse XML", "err", err)
-		return
-	}
-
-	for _, stream := range streams {
-		ch <- prometheus.MustNewConstMetric(e.streamMetrics["bytesIn"], prometheus.CounterValue, stream.BytesIn, stream.Name)
-		ch <- prometheus.MustNewConstMetric(e.streamMetrics["bytesOut"], prometheus.CounterValue, stream.BytesOut, stream.Name)
-		ch <- prometheus.MustNewConstMetric(e.streamMetrics["bandwidthIn"], prometheus.GaugeValue, stream.BandwidthIn, stream.Name)
-		ch <- prometheus.MustNewConstMetric(e.streamMetrics["bandwidthOut"], prometheus.GaugeValue, stream.BandwidhOut, stream.Name)
-		ch <- prometheus.MustNewConstMetric(e.streamMetrics["uptime"], prometheus.CounterValue, stream.Uptime, stream.Name)
-	}
-
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["currentStreams"], prometheus.GaugeValue, float64(len(streams)))
-}
-
-// Describe describes all metrics to be exported to Prometheus
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	for _, metric := range e.serverMetrics {
-		ch <- metric
-	}
-
-	for _, metric := range e.streamMetrics {
-		ch <- metric
-	}
-}
+const namespace = "nginx_rtmp"
 
 func main() {
 	var (
-		listenAddress   = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9728").String()
+		toolkitFlags    = kingpinflag.AddFlags(kingpin.CommandLine, ":9728")
 		metricsPath     = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		scrapeURI       = kingpin.Flag("nginxrtmp.scrape-uri", "URI on which to scrape NGINX-RTMP stats.").Default("http://localhost:8080/stats").String()
+		scrapeURI       = kingpin.Flag("nginxrtmp.scrape-uri", "URI on which to scrape NGINX-RTMP stats: http(s)://host/stats, file:///path/to/stats.xml or unix:///path/to/socket:/stats.").Default("http://localhost:8080/stats").String()
 		timeout         = kingpin.Flag("nginxrtmp.timeout", "Timeout for trying to get stats from NGINX-RTMP.").Default("5s").Duration()
 		pidFile         = kingpin.Flag("nginxrtmp.pid-file", "Optional path to a file containing the NGINX-RTMP PID for additional metrics.").Default("").String()
 		regexStreamName = kingpin.Flag("nginxrtmp.regex-stream-name", "Regex to normalize stream name from NGINX-RTMP").Default(".*").String()
+		collectStreams  = kingpin.Flag("collector.streams", "Enable per-stream metrics.").Default("true").Bool()
+		collectApps     = kingpin.Flag("collector.applications", "Enable per-application metrics.").Default("true").Bool()
+		collectBlocks   = kingpin.Flag("collector.server-blocks", "Enable per-server block metrics.").Default("true").Bool()
+		collectClients  = kingpin.Flag("collector.clients", "Enable per-client metrics.").Default("false").Bool()
+		maxClients      = kingpin.Flag("collector.clients.max-per-stream", "Maximum number of players exported per stream, publishers are always exported (0 means no limit).").Default("100").Int()
+		metricsNaming   = kingpin.Flag("metrics.naming", "Metric naming scheme, legacy or v2. The v2 scheme exports bandwidth in bytes per second.").Default(collector.LegacyNaming).Enum(collector.LegacyNaming, collector.V2Naming)
+		strictParsing   = kingpin.Flag("parse.strict", "Fail the whole scrape when an element of the stats document is missing or malformed, instead of skipping it.").Default("false").Bool()
+		basicAuthUser   = kingpin.Flag("nginxrtmp.basic-auth.username", "Username for basic authentication to the NGINX-RTMP stats.").Default("").String()
+		basicAuthFile   = kingpin.Flag("nginxrtmp.basic-auth.password-file", "File containing the password for basic authentication to the NGINX-RTMP stats, read again when it changes.").Default("").String()
+		bearerTokenFile = kingpin.Flag("nginxrtmp.bearer-token-file", "File containing the bearer token for the NGINX-RTMP stats, read again when it changes.").Default("").String()
+		headers         = kingpin.Flag("nginxrtmp.header", "Header to send to the NGINX-RTMP stats, as Name=value. Can be repeated.").StringMap()
+		tlsCAFile       = kingpin.Flag("nginxrtmp.tls.ca-file", "CA bundle to verify the certificate of the NGINX-RTMP stats.").Default("").String()
+		tlsCertFile     = kingpin.Flag("nginxrtmp.tls.cert-file", "Client certificate for the NGINX-RTMP stats.").Default("").String()
+		tlsKeyFile      = kingpin.Flag("nginxrtmp.tls.key-file", "Key of the client certificate for the NGINX-RTMP stats.").Default("").String()
+		tlsInsecure     = kingpin.Flag("nginxrtmp.tls.insecure-skip-verify", "Don't verify the certificate of the NGINX-RTMP stats.").Default("false").Bool()
+		configFile      = kingpin.Flag("config.file", "Configuration file with the targets of the metrics endpoint and the modules of the /probe endpoint, reloaded on SIGHUP or POST /-/reload.").Default("").String()
+		legacyLabel     = kingpin.Flag("nginxrtmp.legacy-stream-label", "Identify streams by a single stream label made of the application and stream names separated by a dash, instead of application and stream labels.").Default("false").Bool()
+		pollInterval    = kingpin.Flag("nginxrtmp.poll-interval", "Interval to poll NGINX-RTMP in the background and serve the last stats polled, instead of scraping it on each request (0 disables polling).").Default("0s").Duration()
+		maxStaleness    = kingpin.Flag("nginxrtmp.max-staleness", "Age after which the stats polled in the background are no longer served, at least the poll interval (0 means no limit).").Default("1m").Duration()
+		stallWindow     = kingpin.Flag("collector.streams.stall-window", "Time after which a publisher that sent nothing is reported stalled (0 disables stall detection).").Default("0s").Duration()
+		timeoutOffset   = kingpin.Flag("nginxrtmp.timeout-offset", "Offset to subtract from the scrape timeout sent by Prometheus, to answer before Prometheus gives up.").Default("500ms").Duration()
 	)
 
 	promlogConfig := &promlog.Config{}
@@ -311,12 +88,78 @@ func main() {
 	// Compile regex before starting the exporter and exits if it a bad regex
 	streamNameNormalizer := regexp.MustCompile(*regexStreamName)
 
-	exporter, err := NewExporter(*scrapeURI, *timeout, streamNameNormalizer, logger)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error creating an exporter", "err", err)
+	var subCollectors []string
+	for name, enabled := range map[string]bool{
+		collector.StreamsCollector:      *collectStreams,
+		collector.ApplicationsCollector: *collectApps,
+		collector.ServerBlocksCollector: *collectBlocks,
+		collector.ClientsCollector:      *collectClients,
+	} {
+		if enabled {
+			subCollectors = append(subCollectors, name)
+		}
+	}
+	httpConfig := collector.DefaultHTTPConfig
+	if *basicAuthUser != "" || *basicAuthFile != "" {
+		httpConfig.HTTPClientConfig.BasicAuth = &config.BasicAuth{Username: *basicAuthUser, PasswordFile: *basicAuthFile}
+	}
+	if *bearerTokenFile != "" {
+		httpConfig.HTTPClientConfig.Authorization = &config.Authorization{Type: "Bearer", CredentialsFile: *bearerTokenFile}
+	}
+	httpConfig.HTTPClientConfig.TLSConfig = config.TLSConfig{
+		CAFile:             *tlsCAFile,
+		CertFile:           *tlsCertFile,
+		KeyFile:            *tlsKeyFile,
+		InsecureSkipVerify: *tlsInsecure,
+	}
+	httpConfig.Headers = *headers
+
+	// Options shared by the exporter and the collectors of /probe
+	opts := []collector.Option{
+		collector.WithCollectors(subCollectors...),
+		collector.WithMaxClientsPerStream(*maxClients),
+		collector.WithNaming(*metricsNaming),
+		collector.WithTimeout(*timeout),
+	}
+	if *legacyLabel {
+		opts = append(opts, collector.WithLegacyStreamLabel())
+	}
+	if *strictParsing {
+		opts = append(opts, collector.WithStrictParsing())
+	}
+	// Options of the collectors exported on the metrics endpoint
+	var metricsOpts []collector.Option
+	if *pollInterval > 0 {
+		metricsOpts = append(metricsOpts, collector.WithPolling(*pollInterval, *maxStaleness))
+	}
+	if *stallWindow > 0 {
+		metricsOpts = append(metricsOpts, collector.WithStallWindow(*stallWindow))
+	}
+	// The exporter of the flags is only created when the config file has no targets
+	newExporter := func() (*collector.Collector, error) {
+		fetcher, err := collector.NewFetcher(*scrapeURI, *timeout, httpConfig)
+		if err != nil {
+			return nil, err
+		}
+		return collector.New(append(append(opts[:len(opts):len(opts)], metricsOpts...),
+			collector.WithFetcher(fetcher),
+			collector.WithStreamNameNormalizer(streamNameNormalizer),
+			collector.WithLogger(logger),
+		)...)
+	}
+	defaultModule := newDefaultModule(*timeout, streamNameNormalizer)
+	configReloader := newReloader(*configFile, defaultModule, newExporter, opts, metricsOpts, logger)
+	if err := configReloader.load(); err != nil {
+		if *configFile != "" {
+			level.Error(logger).Log("msg", "Error loading config", "err", err)
+		} else {
+			level.Error(logger).Log("msg", "Error creating an exporter", "err", err)
+		}
 		os.Exit(1)
 	}
-	prometheus.MustRegister(exporter)
+	if *configFile != "" {
+		configReloader.watchSignals()
+	}
 	prometheus.MustRegister(collectors.NewBuildInfoCollector())
 
 	level.Info(logger).Log("msg", "PID File:", pidFile)
@@ -338,19 +181,23 @@ func main() {
 		prometheus.MustRegister(procExporter)
 	}
 
-	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
-	http.Handle(*metricsPath, promhttp.Handler())
+	// The targets of the config file replace the exporter when there are some
+	http.Handle(*metricsPath, metricsHandler(configReloader.targets, *timeoutOffset))
+	http.Handle("/probe", probeHandler(configReloader, *timeoutOffset, logger))
+	http.Handle("/-/reload", configReloader)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>NGINX-RTMP exporter</title></head>
 			<body>
 			<h1>NGINX-RTMP exporter</h1>
 			<p><a href='` + *metricsPath + `'>Metrics</a></p>
+			<p><a href='/probe?target=http://localhost:8080/stats'>Probe http://localhost:8080/stats</a></p>
 			</body>
 			</html>`,
 		))
 	})
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	srv := &http.Server{}
+	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
 	}
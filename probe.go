@@ -0,0 +1,102 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
+)
+
+// newDefaultModule returns the module of /probe requests without a module
+// parameter. The credentials of the flags are only sent to the scrape URI,
+// /probe targets get them from the modules of the config file.
+func newDefaultModule(timeout time.Duration, streamNameNormalizer *regexp.Regexp) *Module {
+	return &Module{
+		Timeout:              model.Duration(timeout),
+		HTTPClientConfig:     collector.DefaultHTTPConfig,
+		streamNameNormalizer: streamNameNormalizer,
+	}
+}
+
+// probeHandler scrapes the stats URI given by the target parameter with a
+// fresh collector, configured by the module parameter. The default module has
+// the timeout and stream name regex of the command-line flags, without their
+// credentials, the others come from the configuration file.
+func probeHandler(r *reloader, timeoutOffset time.Duration, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := req.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		module := r.defaultModule
+		if name := req.URL.Query().Get("module"); name != "" {
+			var ok bool
+			if module, ok = r.config().Modules[name]; !ok {
+				http.Error(w, fmt.Sprintf("unknown module %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := module.allowsTarget(target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger := log.With(logger, "target", target)
+		fetcher, err := collector.NewFetcher(target, time.Duration(module.Timeout), module.HTTPClientConfig)
+		if err != nil {
+			level.Debug(logger).Log("msg", "Error creating a fetcher", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := r.probeCollector(module, fetcher, logger)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The fetcher is thrown away with the collector
+		defer c.Close()
+
+		ctx, cancel, err := scrapeContext(req, timeoutOffset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(boundCollector{c, ctx})
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+	})
+}
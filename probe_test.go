@@ -0,0 +1,186 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/config"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
+)
+
+// statsServer serves the stats page of the mock server, recording the
+// headers of the requests by path
+type statsServer struct {
+	*httptest.Server
+	page    []byte
+	mutex   sync.Mutex
+	headers map[string]http.Header
+}
+
+func newStatsServer(t *testing.T) *statsServer {
+	t.Helper()
+	page, err := os.ReadFile("tests/stats.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &statsServer{page: page, headers: make(map[string]http.Header)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.headers[r.URL.Path] = r.Header.Clone()
+		s.mutex.Unlock()
+		w.Write(s.page)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// header returns the headers of the last request of path
+func (s *statsServer) header(path string) http.Header {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.headers[path]
+}
+
+// probe requests /probe with the query, returning the response
+func probe(t *testing.T, r *reloader, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/probe?"+query.Encode(), nil)
+	probeHandler(r, 0, r.logger).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProbeTargets(t *testing.T) {
+	server := newStatsServer(t)
+	stats, err := filepath.Abs("tests/stats.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestReloader(t, `
+modules:
+  local:
+    allow_local_targets: true
+`, nil)
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		module string
+		status int
+	}{
+		{name: "http", target: server.URL + "/stats", status: http.StatusOK},
+		{name: "no target", status: http.StatusBadRequest},
+		{name: "file", target: "file://" + stats, status: http.StatusBadRequest},
+		{name: "unix", target: "unix:///run/nginx.sock:/stats", status: http.StatusBadRequest},
+		{name: "unsupported scheme", target: "ftp://localhost/stats", status: http.StatusBadRequest},
+		{name: "unknown module", target: server.URL + "/stats", module: "unknown", status: http.StatusBadRequest},
+		{name: "file allowed by the module", target: "file://" + stats, module: "local", status: http.StatusOK},
+		{name: "http with the module", target: server.URL + "/stats", module: "local", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{}
+			if test.target != "" {
+				query.Set("target", test.target)
+			}
+			if test.module != "" {
+				query.Set("module", test.module)
+			}
+			rec := probe(t, r, query)
+			if rec.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, test.status, rec.Body)
+			}
+			if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), "\nnginx_rtmp_up 1\n") {
+				t.Errorf("failed probe:\n%s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestProbeWithoutFlagCredentials(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		auth func(*config.HTTPClientConfig)
+	}{
+		{name: "basic auth", auth: func(c *config.HTTPClientConfig) {
+			c.BasicAuth = &config.BasicAuth{Username: "user", PasswordFile: passwordFile}
+		}},
+		{name: "bearer token", auth: func(c *config.HTTPClientConfig) {
+			c.Authorization = &config.Authorization{Type: "Bearer", CredentialsFile: passwordFile}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newStatsServer(t)
+			// As set by the command-line flags
+			httpConfig := collector.DefaultHTTPConfig
+			test.auth(&httpConfig.HTTPClientConfig)
+			httpConfig.Headers = map[string]string{"X-Api-Key": "secret"}
+			r := newTestReloader(t, "", func() (*collector.Collector, error) {
+				fetcher, err := collector.NewFetcher(server.URL+"/scrape-uri", time.Second, httpConfig)
+				if err != nil {
+					return nil, err
+				}
+				return collector.New(collector.WithFetcher(fetcher))
+			})
+			if err := r.load(); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			metricsHandler(r.targets, 0).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			header := server.header("/scrape-uri")
+			if header.Get("Authorization") == "" || header.Get("X-Api-Key") != "secret" {
+				t.Fatalf("scrape URI got headers %v, want the credentials of the flags", header)
+			}
+
+			rec = probe(t, r, url.Values{"target": {server.URL + "/probe-target"}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			header = server.header("/probe-target")
+			if header == nil {
+				t.Fatal("probe target not scraped")
+			}
+			if header.Get("Authorization") != "" || header.Get("X-Api-Key") != "" {
+				t.Errorf("probe target got the credentials of the flags: %v", header)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
+)
+
+// reloader keeps the configuration file loaded, and the collectors of its
+// targets. A configuration that fails to load leaves the previous one active.
+type reloader struct {
+	path          string
+	defaultModule *Module
+	newExporter   func() (*collector.Collector, error) // of the command-line flags
+	opts          []collector.Option                   // shared with /probe
+	metricsOpts   []collector.Option
+	logger        log.Logger
+	targets       *targetsCollector
+
+	reloadMutex sync.Mutex                  // To serialize reloads
+	exporter    *collector.Collector        // nil while the targets of the config file replace it
+	loaded      map[string]*targetCollector // the targets of the config file by name
+	mutex       sync.RWMutex
+	cfg         *Config
+}
+
+func newReloader(path string, defaultModule *Module, newExporter func() (*collector.Collector, error), opts, metricsOpts []collector.Option, logger log.Logger) *reloader {
+	return &reloader{
+		path:          path,
+		defaultModule: defaultModule,
+		newExporter:   newExporter,
+		opts:          opts,
+		metricsOpts:   metricsOpts,
+		logger:        logger,
+		targets:       &targetsCollector{},
+		cfg:           &Config{},
+	}
+}
+
+// load starts collecting the targets of the configuration file, or the
+// exporter of the command-line flags without configuration file
+func (r *reloader) load() error {
+	if r.path != "" {
+		return r.reload()
+	}
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	exporter, err := r.flagExporter()
+	if err != nil {
+		return err
+	}
+	r.targets.set([]*collector.Collector{exporter})
+	return nil
+}
+
+// flagExporter returns the exporter of the command-line flags, creating it
+// when it isn't in use
+func (r *reloader) flagExporter() (*collector.Collector, error) {
+	if r.exporter == nil {
+		exporter, err := r.newExporter()
+		if err != nil {
+			return nil, fmt.Errorf("can't create the exporter of the command-line flags: %w", err)
+		}
+		r.exporter = exporter
+	}
+	return r.exporter, nil
+}
+
+// config returns the active configuration
+func (r *reloader) config() *Config {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cfg
+}
+
+// reload loads the configuration file again. The collectors of its targets
+// replace the exporter of the command-line flags, unless there are none.
+func (r *reloader) reload() error {
+	if r.path == "" {
+		return errors.New("no configuration file")
+	}
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if err := r.checkModules(cfg.Modules); err != nil {
+		return err
+	}
+	var (
+		collectors []*collector.Collector
+		loaded     map[string]*targetCollector
+	)
+	if len(cfg.Targets) > 0 {
+		if loaded, err = r.targetCollectors(cfg.Targets); err != nil {
+			return err
+		}
+		for _, target := range cfg.Targets {
+			collectors = append(collectors, loaded[target.Name].collector)
+		}
+	} else {
+		exporter, err := r.flagExporter()
+		if err != nil {
+			return err
+		}
+		collectors = []*collector.Collector{exporter}
+	}
+
+	r.mutex.Lock()
+	r.cfg = cfg
+	r.mutex.Unlock()
+	r.targets.set(collectors)
+	r.loaded = loaded
+	if len(cfg.Targets) > 0 {
+		// It was closed when replaced
+		r.exporter = nil
+	}
+	level.Info(r.logger).Log("msg", "Loaded config file", "file", r.path, "targets", len(cfg.Targets), "modules", len(cfg.Modules))
+	return nil
+}
+
+// probeCollector creates the collector of a /probe request with a module
+func (r *reloader) probeCollector(module *Module, fetcher collector.Fetcher, logger log.Logger) (*collector.Collector, error) {
+	opts := append(r.opts[:len(r.opts):len(r.opts)], module.options()...)
+	return collector.New(append(opts,
+		collector.WithFetcher(fetcher),
+		collector.WithConstLabels(module.constLabels()),
+		collector.WithLogger(logger),
+		collector.WithoutLifecycle(),
+	)...)
+}
+
+// checkModules creates the collector of each module, and checks its metrics,
+// so that /probe doesn't find out about invalid settings
+func (r *reloader) checkModules(modules map[string]*Module) error {
+	unused := collector.FetcherFunc(func(context.Context) (io.ReadCloser, error) {
+		return nil, errors.New("not scraped")
+	})
+	for name, module := range modules {
+		c, err := r.probeCollector(module, unused, r.logger)
+		if err != nil {
+			return fmt.Errorf("module %q: %w", name, err)
+		}
+		if err := prometheus.NewPedanticRegistry().Register(c); err != nil {
+			return fmt.Errorf("module %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// targetCollector is the collector of a target of the configuration file
+type targetCollector struct {
+	target    *Target
+	collector *collector.Collector
+}
+
+// targetCollectors creates the collectors of the targets, and checks that
+// their metrics are consistent with each other. The collectors of the targets
+// loaded are kept when their settings are unchanged, with the state of the
+// streams they track.
+func (r *reloader) targetCollectors(targets []*Target) (map[string]*targetCollector, error) {
+	registry := prometheus.NewPedanticRegistry()
+	collectors := make(map[string]*targetCollector, len(targets))
+	for _, target := range targets {
+		tc, ok := r.loaded[target.Name]
+		if !ok || !tc.target.equal(target) {
+			c, err := r.newTargetCollector(target)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: %w", target.Name, err)
+			}
+			tc = &targetCollector{target: target, collector: c}
+		}
+		if err := registry.Register(tc.collector); err != nil {
+			return nil, fmt.Errorf("target %q: %w", target.Name, err)
+		}
+		collectors[target.Name] = tc
+	}
+	return collectors, nil
+}
+
+// newTargetCollector creates the collector of a target
+func (r *reloader) newTargetCollector(target *Target) (*collector.Collector, error) {
+	module := &target.Module
+	fetcher, err := collector.NewFetcher(target.URI, time.Duration(module.Timeout), module.HTTPClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	labels := module.constLabels()
+	labels[targetLabel] = target.Name
+	opts := append(append(r.opts[:len(r.opts):len(r.opts)], r.metricsOpts...), module.options()...)
+	return collector.New(append(opts,
+		collector.WithFetcher(fetcher),
+		collector.WithConstLabels(labels),
+		collector.WithLogger(log.With(r.logger, targetLabel, target.Name)),
+	)...)
+}
+
+// watchSignals reloads the configuration file on SIGHUP
+func (r *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.reload(); err != nil {
+				level.Error(r.logger).Log("msg", "Error reloading config", "err", err)
+			}
+		}
+	}()
+}
+
+// ServeHTTP reloads the configuration file on POST /-/reload
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		level.Error(r.logger).Log("msg", "Error reloading config", "err", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusBadRequest)
+	}
+}
+
+// targetsCollector collects the NGINX-RTMP servers of the configuration file
+// concurrently. It is unchecked, as the targets change on reload.
+type targetsCollector struct {
+	mutex      sync.RWMutex
+	collectors []*collector.Collector
+	cancels    map[*collector.Collector]context.CancelFunc // stop the polling of each collector
+}
+
+// set replaces the collectors. The collectors replaced stop polling and are
+// closed before the new ones start polling, when they poll in the background,
+// and the collectors kept keep polling.
+func (t *targetsCollector) set(collectors []*collector.Collector) {
+	t.mutex.Lock()
+	previous, cancels := t.collectors, t.cancels
+	t.collectors, t.cancels = collectors, make(map[*collector.Collector]context.CancelFunc, len(collectors))
+	for _, c := range previous {
+		if slices.Contains(collectors, c) {
+			t.cancels[c] = cancels[c]
+			continue
+		}
+		cancels[c]()
+		c.Close()
+	}
+	for _, c := range collectors {
+		if _, ok := t.cancels[c]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.cancels[c] = cancel
+		go c.Run(ctx)
+	}
+	t.mutex.Unlock()
+}
+
+// Describe sends nothing, making the collector unchecked
+func (t *targetsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (t *targetsCollector) Collect(ch chan<- prometheus.Metric) {
+	t.CollectContext(context.Background(), ch)
+}
+
+// CollectContext collects the targets, bounded by the deadline of ctx
+func (t *targetsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t.mutex.RLock()
+	collectors := t.collectors
+	t.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, c := range collectors {
+		wg.Add(1)
+		go func(c *collector.Collector) {
+			defer wg.Done()
+			c.CollectContext(ctx, ch)
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,216 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/mauricioabreu/nginx_rtmp_prometheus/collector"
+)
+
+// newTestReloader returns a reloader of a configuration file with content,
+// creating the exporter of the flags with newExporter, or with one that
+// never scrapes when nil
+func newTestReloader(t *testing.T, content string, newExporter func() (*collector.Collector, error)) *reloader {
+	t.Helper()
+	if newExporter == nil {
+		newExporter = func() (*collector.Collector, error) {
+			return collector.New(collector.WithFetcher(&countingFetcher{}))
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig(t, path, content)
+	r := newReloader(path, newDefaultModule(time.Second, regexp.MustCompile(".*")), newExporter, nil, nil, log.NewNopLogger())
+	t.Cleanup(func() { r.targets.set(nil) })
+	return r
+}
+
+// writeConfig replaces the configuration file at path
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingFetcher fails its fetches, counting them
+type countingFetcher struct {
+	fetches atomic.Int32
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	f.fetches.Add(1)
+	return nil, errors.New("not served")
+}
+
+func TestReloadKeepsUnchangedTargets(t *testing.T) {
+	r := newTestReloader(t, `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+  - name: b
+    uri: file:///run/b.xml
+`, nil)
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	before := r.loaded
+
+	writeConfig(t, r.path, `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+  - name: b
+    uri: file:///run/b2.xml
+  - name: c
+    uri: file:///run/c.xml
+`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.loaded["a"].collector != before["a"].collector {
+		t.Error("collector of the unchanged target replaced")
+	}
+	if r.loaded["b"].collector == before["b"].collector {
+		t.Error("collector of the changed target kept")
+	}
+	if len(r.targets.collectors) != 3 {
+		t.Errorf("%d collectors, want 3", len(r.targets.collectors))
+	}
+}
+
+func TestReloadKeepsPollingExporter(t *testing.T) {
+	fetcher := &countingFetcher{}
+	exporters := 0
+	r := newTestReloader(t, "", func() (*collector.Collector, error) {
+		exporters++
+		return collector.New(collector.WithFetcher(fetcher), collector.WithPolling(time.Hour, 0))
+	})
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Run polls right away, and only once in an hour
+	time.Sleep(100 * time.Millisecond)
+	if exporters != 1 {
+		t.Errorf("%d exporters created, want 1", exporters)
+	}
+	if got := fetcher.fetches.Load(); got != 1 {
+		t.Errorf("%d polls, want 1", got)
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	r := newTestReloader(t, `
+modules:
+  edge:
+    timeout: 2s
+targets:
+  - name: a
+    uri: file:///run/a.xml
+`, nil)
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, collectors := r.config(), r.targets.collectors
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unparsable", content: "targets: ["},
+		{name: "duplicate target", content: `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+  - name: a
+    uri: file:///run/b.xml
+`},
+		{name: "invalid label name", content: `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+    labels:
+      __region: eu
+`},
+		{name: "invalid stream name rule regex", content: `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+    stream_name_rules:
+      - regex: '('
+        replacement: ''
+`},
+		{name: "different label sets", content: `
+targets:
+  - name: a
+    uri: file:///run/a.xml
+  - name: b
+    uri: file:///run/b.xml
+    labels:
+      region: eu
+`},
+		{name: "invalid target uri", content: `
+targets:
+  - name: a
+    uri: file://run/a.xml
+`},
+		{name: "invalid module", content: `
+modules:
+  edge:
+    collectors: [unknown]
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeConfig(t, r.path, test.content)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if r.config() != cfg {
+				t.Error("previous config replaced")
+			}
+			if !slices.Equal(r.targets.collectors, collectors) {
+				t.Error("previous targets replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package rtmpstat
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Required elements, by parent element
+var required = map[string][]string{
+	"rtmp":        {"bytes_in", "bytes_out", "bw_in", "bw_out", "uptime"},
+	"application": {"name"},
+	"stream":      {"name", "bytes_in", "bytes_out", "bw_in", "bw_out", "time"},
+	"client":      {"id", "address", "time", "dropped", "avsync"},
+}
+
+// Required elements of the streams and clients of the play section, which
+// NGINX-RTMP writes without counters
+var playRequired = map[string][]string{
+	"stream": {"name"},
+	"client": {"id"},
+}
+
+// Decoder reads the stats document token by token, so Walk doesn't use more
+// memory with the number of streams and clients. Missing or malformed elements
+// are skipped: applications and streams without a name and clients without an
+// id are left out, other values are left as NaN.
+type Decoder struct {
+	// Strict makes decoding stop at the first missing or malformed element
+	Strict bool
+
+	// FieldErrors counts the elements skipped by the last decoding, by
+	// "parent/child" element name
+	FieldErrors map[string]int
+
+	first   error
+	handler Handler
+	seen    map[string]bool // elements of the current parents, as "parent/child"
+
+	root        bool
+	stats       Stats
+	servers     int
+	loc         Location
+	application Application
+	section     *Section
+	stream      Stream
+	client      Client
+	appNamed    bool
+	streamNamed bool
+	clientHasID bool
+}
+
+// Walk reads a stats document from r, handing its parts to h as soon as they
+// are decoded
+func (d *Decoder) Walk(r io.Reader, h Handler) error {
+	*d = Decoder{
+		Strict:      d.Strict,
+		FieldErrors: make(map[string]int),
+		handler:     h,
+		seen:        make(map[string]bool),
+	}
+
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	var (
+		path []string
+		text strings.Builder
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			text.Reset()
+			d.start(path)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			d.end(path, text.String())
+			path = path[:len(path)-1]
+			text.Reset()
+			if d.Strict && d.first != nil {
+				return d.first
+			}
+		}
+	}
+	if !d.root {
+		return &FieldError{Element: "rtmp", Err: ErrMissingElement}
+	}
+	return nil
+}
+
+func (d *Decoder) start(path []string) {
+	name, parent := path[len(path)-1], parentOf(path)
+	switch {
+	case name == "rtmp" && !d.root:
+		d.root = true
+		d.stats = Stats{
+			PID: math.NaN(), Uptime: math.NaN(), Accepted: math.NaN(),
+			BytesIn: math.NaN(), BytesOut: math.NaN(), BandwidthIn: math.NaN(), BandwidthOut: math.NaN(),
+		}
+	case name == "server" && parent == "rtmp":
+		d.loc = Location{Server: d.servers}
+		d.servers++
+	case name == "application" && parent == "server":
+		d.application = Application{}
+		d.appNamed = false
+	case isSection(name) && parent == "application":
+		d.section = &Section{NClients: math.NaN()}
+		if name == "live" {
+			d.application.Live = d.section
+		} else {
+			d.application.Play = d.section
+		}
+		d.loc.Section = name
+	case name == "stream" && isSection(parent):
+		d.stream = Stream{
+			Time: math.NaN(), BytesIn: math.NaN(), BytesOut: math.NaN(), BandwidthIn: math.NaN(), BandwidthOut: math.NaN(),
+			BandwidthAudio: math.NaN(), BandwidthVideo: math.NaN(), NClients: math.NaN(),
+		}
+		d.streamNamed = false
+	case name == "client" && parent == "stream":
+		d.client = Client{Time: math.NaN(), Dropped: math.NaN(), AVSync: math.NaN(), Timestamp: math.NaN()}
+		d.clientHasID = false
+	case name == "video" && parent == "meta":
+		d.stream.Meta.Video = &VideoMeta{Width: math.NaN(), Height: math.NaN(), FrameRate: math.NaN(), Compat: math.NaN()}
+	case name == "audio" && parent == "meta":
+		d.stream.Meta.Audio = &AudioMeta{Channels: math.NaN(), SampleRate: math.NaN()}
+	}
+}
+
+func (d *Decoder) end(path []string, text string) {
+	name, parent := path[len(path)-1], parentOf(path)
+	d.seen[parent+"/"+name] = true
+
+	switch parent {
+	case "rtmp":
+		d.statsField(name, text)
+	case "application":
+		if name == "name" {
+			d.application.Name, d.appNamed = text, true
+			d.loc.Application = text
+		}
+	case "live", "play":
+		if name == "nclients" && d.section != nil {
+			d.section.NClients = d.float(parent, name, text)
+		}
+	case "stream":
+		d.streamField(name, text)
+	case "client":
+		d.clientField(name, text)
+	case "video":
+		d.videoField(name, text)
+	case "audio":
+		d.audioField(name, text)
+	}
+
+	switch {
+	case name == "client" && parent == "stream":
+		d.endClient()
+	case name == "video" && parent == "meta":
+		if d.stream.Meta.Video != nil && d.stream.Meta.Video.Codec == "" {
+			d.stream.Meta.Video = nil
+		}
+	case name == "audio" && parent == "meta":
+		if d.stream.Meta.Audio != nil && d.stream.Meta.Audio.Codec == "" {
+			d.stream.Meta.Audio = nil
+		}
+	case name == "stream" && isSection(parent):
+		d.endStream()
+	case isSection(name) && parent == "application":
+		d.section = nil
+		d.loc.Section = ""
+	case name == "application" && parent == "server":
+		d.endApplication()
+	case name == "server" && parent == "rtmp":
+		d.handler.Server(Location{Server: d.loc.Server}, Server{})
+	case name == "rtmp":
+		d.require("rtmp")
+		d.handler.Stats(d.stats)
+	}
+}
+
+func (d *Decoder) statsField(name, text string) {
+	switch name {
+	case "nginx_version":
+		d.stats.NginxVersion = text
+	case "nginx_rtmp_version":
+		d.stats.NginxRTMPVersion = text
+	case "compiler":
+		d.stats.Compiler = text
+	case "built":
+		d.stats.Built = text
+	case "pid":
+		d.stats.PID = d.float("rtmp", name, text)
+	case "uptime":
+		d.stats.Uptime = d.float("rtmp", name, text)
+	case "naccepted":
+		d.stats.Accepted = d.float("rtmp", name, text)
+	case "bytes_in":
+		d.stats.BytesIn = d.float("rtmp", name, text)
+	case "bytes_out":
+		d.stats.BytesOut = d.float("rtmp", name, text)
+	case "bw_in":
+		d.stats.BandwidthIn = d.float("rtmp", name, text)
+	case "bw_out":
+		d.stats.BandwidthOut = d.float("rtmp", name, text)
+	}
+}
+
+func (d *Decoder) streamField(name, text string) {
+	switch name {
+	case "name":
+		d.stream.Name, d.streamNamed = text, true
+	case "time":
+		d.stream.Time = d.float("stream", name, text) / 1000 // it is in miliseconds
+	case "bytes_in":
+		d.stream.BytesIn = d.float("stream", name, text)
+	case "bytes_out":
+		d.stream.BytesOut = d.float("stream", name, text)
+	case "bw_in":
+		d.stream.BandwidthIn = d.float("stream", name, text)
+	case "bw_out":
+		d.stream.BandwidthOut = d.float("stream", name, text)
+	case "bw_audio":
+		d.stream.BandwidthAudio = d.float("stream", name, text)
+	case "bw_video":
+		d.stream.BandwidthVideo = d.float("stream", name, text)
+	case "nclients":
+		d.stream.NClients = d.float("stream", name, text)
+	case "publishing":
+		d.stream.Publishing = true
+	case "active":
+		d.stream.Active = true
+	}
+}
+
+func (d *Decoder) clientField(name, text string) {
+	switch name {
+	case "id":
+		d.client.ID, d.clientHasID = text, true
+	case "address":
+		d.client.Address = text
+	case "flashver":
+		d.client.FlashVer = text
+	case "swfurl":
+		d.client.SWFURL = text
+	case "pageurl":
+		d.client.PageURL = text
+	case "time":
+		d.client.Time = d.float("client", name, text) / 1000 // it is in miliseconds
+	case "dropped":
+		d.client.Dropped = d.float("client", name, text)
+	case "avsync":
+		// Empty when the application interleaves audio and video
+		if strings.TrimSpace(text) != "" {
+			d.client.AVSync = d.float("client", name, text) / 1000 // it is in miliseconds
+		}
+	case "timestamp":
+		d.client.Timestamp = d.float("client", name, text) / 1000 // it is in miliseconds
+	case "publishing":
+		d.client.Publishing = true
+	case "active":
+		d.client.Active = true
+	}
+}
+
+func (d *Decoder) videoField(name, text string) {
+	video := d.stream.Meta.Video
+	if video == nil {
+		return
+	}
+	switch name {
+	case "codec":
+		video.Codec = text
+	case "profile":
+		video.Profile = text
+	case "level":
+		video.Level = text
+	case "width":
+		video.Width = d.float("video", name, text)
+	case "height":
+		video.Height = d.float("video", name, text)
+	case "frame_rate":
+		video.FrameRate = d.float("video", name, text)
+	case "compat":
+		video.Compat = d.float("video", name, text)
+	}
+}
+
+func (d *Decoder) audioField(name, text string) {
+	audio := d.stream.Meta.Audio
+	if audio == nil {
+		return
+	}
+	switch name {
+	case "codec":
+		audio.Codec = text
+	case "profile":
+		audio.Profile = text
+	case "channels":
+		audio.Channels = d.float("audio", name, text)
+	case "sample_rate":
+		audio.SampleRate = d.float("audio", name, text)
+	}
+}
+
+func (d *Decoder) endClient() {
+	d.require("client")
+	if !d.clientHasID || !d.streamNamed || !d.appNamed {
+		return
+	}
+	loc := d.loc
+	loc.Stream = d.stream.Name
+	d.handler.Client(loc, d.client)
+}
+
+func (d *Decoder) endStream() {
+	d.require("stream")
+	if !d.streamNamed || !d.appNamed {
+		return
+	}
+	d.handler.Stream(d.loc, d.stream)
+}
+
+func (d *Decoder) endApplication() {
+	d.require("application")
+	if d.appNamed {
+		d.handler.Application(Location{Server: d.loc.Server, Application: d.application.Name}, d.application)
+	}
+	d.loc.Application = ""
+}
+
+// require records the required children of parent that were not seen, and
+// forgets the children seen so far
+func (d *Decoder) require(parent string) {
+	names := required[parent]
+	if play, ok := playRequired[parent]; ok && d.loc.Section == "play" {
+		names = play
+	}
+	for _, name := range names {
+		element := parent + "/" + name
+		if !d.seen[element] {
+			d.fail(element, ErrMissingElement)
+		}
+	}
+	for element := range d.seen {
+		if strings.HasPrefix(element, parent+"/") {
+			delete(d.seen, element)
+		}
+	}
+}
+
+// float parses the value of a numeric element, or returns NaN
+func (d *Decoder) float(parent, name, text string) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil {
+		d.fail(parent+"/"+name, err)
+		return math.NaN()
+	}
+	return n
+}
+
+// fail records an element that could not be read
+func (d *Decoder) fail(element string, err error) {
+	d.FieldErrors[element]++
+	if d.first == nil {
+		d.first = &FieldError{Element: element, Err: err}
+	}
+}
+
+func isSection(name string) bool {
+	return name == "live" || name == "play"
+}
+
+func parentOf(path []string) string {
+	if len(path) < 2 {
+		return ""
+	}
+	return path[len(path)-2]
+}
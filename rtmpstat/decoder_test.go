@@ -0,0 +1,502 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package rtmpstat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/antchfx/xmlquery"
+)
+
+var (
+	benchStreams = flag.Int("streams", 2000, "Number of streams in the document of the benchmarks.")
+	benchClients = flag.Int("clients", 20, "Number of clients of every stream in the document of the benchmarks.")
+)
+
+// readStats returns the stats page served by the mock server
+func readStats(t testing.TB) string {
+	t.Helper()
+	content, err := os.ReadFile("../tests/stats.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// playSection is a play section as written by NGINX-RTMP, whose streams and
+// clients have no counters
+const playSection = `
+      <play>
+        <stream>
+          <name>vod.mp4</name>
+          <client>
+            <id>7</id>
+            <address>203.0.113.9</address>
+            <time>4500</time>
+            <flashver>LNX 9,0,124,2</flashver>
+            <swfurl></swfurl>
+            <active />
+          </client>
+          <active />
+          <nclients>1</nclients>
+        </stream>
+        <nclients>1</nclients>
+      </play>`
+
+// withPlaySection adds a play section to the first application of a stats page
+func withPlaySection(s string) string {
+	return strings.Replace(s, "</live>", "</live>"+playSection, 1)
+}
+
+// findStream returns the live stream of an application, or nil
+func findStream(stats *Stats, application, name string) *Stream {
+	for _, server := range stats.Servers {
+		for _, app := range server.Applications {
+			if app.Name != application || app.Live == nil {
+				continue
+			}
+			for i := range app.Live.Streams {
+				if app.Live.Streams[i].Name == name {
+					return &app.Live.Streams[i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applicationNames returns the names of the applications of every server
+func applicationNames(stats *Stats) []string {
+	var names []string
+	for _, server := range stats.Servers {
+		for _, app := range server.Applications {
+			names = append(names, app.Name)
+		}
+	}
+	return names
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		edit        func(string) string
+		strict      bool
+		fieldErrors map[string]int
+		checkErr    func(*testing.T, error)
+		check       func(*testing.T, *Stats)
+	}{
+		{
+			name:        "whole document",
+			fieldErrors: map[string]int{},
+			check: func(t *testing.T, stats *Stats) {
+				if stats.NginxVersion != "1.16.1" || stats.Uptime != 122 || stats.BandwidthIn != 6937192 {
+					t.Errorf("stats = %s %v %v, want 1.16.1 122 6937192", stats.NginxVersion, stats.Uptime, stats.BandwidthIn)
+				}
+				if names := applicationNames(stats); !reflect.DeepEqual(names, []string{"stream", "hls"}) {
+					t.Errorf("applications = %v, want [stream hls]", names)
+				}
+				stream := findStream(stats, "stream", "hello")
+				if stream == nil {
+					t.Fatal("stream hello not decoded")
+				}
+				if stream.Time != 118.94 || stream.BandwidthIn != 1541776 || stream.BytesIn != 20908965 || !stream.Publishing {
+					t.Errorf("stream hello = %+v", stream)
+				}
+				if stream.Meta.Video == nil || stream.Meta.Video.Codec != "H264" || stream.Meta.Video.Width != 1280 {
+					t.Errorf("video of stream hello = %+v, want H264 1280", stream.Meta.Video)
+				}
+				if stream.Meta.Audio != nil {
+					t.Errorf("audio of stream hello = %+v, want none", stream.Meta.Audio)
+				}
+				if len(stream.Clients) != 2 || stream.Clients[1].ID != "1" || !stream.Clients[1].Publishing || stream.Clients[1].AVSync != -118.9 {
+					t.Errorf("clients of stream hello = %+v", stream.Clients)
+				}
+			},
+		},
+		{
+			name:        "play section",
+			edit:        withPlaySection,
+			fieldErrors: map[string]int{},
+			check: func(t *testing.T, stats *Stats) {
+				play := stats.Servers[0].Applications[0].Play
+				if play == nil || len(play.Streams) != 1 || play.NClients != 1 {
+					t.Fatalf("play section = %+v, want one stream and one client", play)
+				}
+				stream := play.Streams[0]
+				if stream.Name != "vod.mp4" || !math.IsNaN(stream.BandwidthIn) || len(stream.Clients) != 1 {
+					t.Errorf("stream vod.mp4 = %+v", stream)
+				}
+				if client := stream.Clients[0]; client.ID != "7" || client.Time != 4.5 || !math.IsNaN(client.Dropped) || !math.IsNaN(client.AVSync) {
+					t.Errorf("client of stream vod.mp4 = %+v", client)
+				}
+			},
+		},
+		{
+			name: "empty avsync",
+			edit: func(s string) string {
+				return strings.Replace(s, "<avsync>-118900</avsync>", "<avsync></avsync>", 1)
+			},
+			fieldErrors: map[string]int{},
+			check: func(t *testing.T, stats *Stats) {
+				stream := findStream(stats, "stream", "hello")
+				if stream == nil || len(stream.Clients) != 2 {
+					t.Fatalf("stream hello = %+v, want two clients", stream)
+				}
+				if !math.IsNaN(stream.Clients[0].AVSync) || stream.Clients[1].AVSync != -118.9 {
+					t.Errorf("avsync of the clients of stream hello = %v %v, want NaN -118.9", stream.Clients[0].AVSync, stream.Clients[1].AVSync)
+				}
+			},
+		},
+		{
+			name: "missing bw_in",
+			edit: func(s string) string {
+				return strings.Replace(s, "<bw_in>1541776</bw_in>", "", 1)
+			},
+			fieldErrors: map[string]int{"stream/bw_in": 1},
+			check: func(t *testing.T, stats *Stats) {
+				stream := findStream(stats, "stream", "hello")
+				if stream == nil {
+					t.Fatal("stream hello not decoded")
+				}
+				if !math.IsNaN(stream.BandwidthIn) {
+					t.Errorf("bandwidth in of stream hello = %v, want NaN", stream.BandwidthIn)
+				}
+				if stream.BytesIn != 20908965 {
+					t.Errorf("bytes in of stream hello = %v, want 20908965", stream.BytesIn)
+				}
+			},
+		},
+		{
+			name: "malformed bw_in",
+			edit: func(s string) string {
+				return strings.Replace(s, "<bw_in>1541776</bw_in>", "<bw_in>fast</bw_in>", 1)
+			},
+			fieldErrors: map[string]int{"stream/bw_in": 1},
+			check: func(t *testing.T, stats *Stats) {
+				if stream := findStream(stats, "stream", "hello"); stream == nil || !math.IsNaN(stream.BandwidthIn) {
+					t.Errorf("stream hello = %+v, want a NaN bandwidth in", stream)
+				}
+			},
+		},
+		{
+			name: "stream without a name",
+			edit: func(s string) string {
+				return strings.Replace(s, "<name>hello</name>", "", 1)
+			},
+			fieldErrors: map[string]int{"stream/name": 1},
+			check: func(t *testing.T, stats *Stats) {
+				app := stats.Servers[0].Applications[0]
+				if app.Name != "stream" || len(app.Live.Streams) != 0 {
+					t.Errorf("application %q has %d streams, want stream with none", app.Name, len(app.Live.Streams))
+				}
+				if stream := findStream(stats, "hls", "hello_240p264kbs"); stream == nil {
+					t.Error("stream hello_240p264kbs not decoded")
+				}
+			},
+		},
+		{
+			name: "application without a name",
+			edit: func(s string) string {
+				return strings.Replace(s, "<name>stream</name>", "", 1)
+			},
+			fieldErrors: map[string]int{"application/name": 1},
+			check: func(t *testing.T, stats *Stats) {
+				if names := applicationNames(stats); !reflect.DeepEqual(names, []string{"hls"}) {
+					t.Errorf("applications = %v, want [hls]", names)
+				}
+				if len(stats.Servers[0].Applications[0].Live.Streams) != 5 {
+					t.Errorf("application hls has %d streams, want 5", len(stats.Servers[0].Applications[0].Live.Streams))
+				}
+			},
+		},
+		{
+			name: "truncated document",
+			edit: func(s string) string {
+				return s[:strings.Index(s, "<name>hls</name>")]
+			},
+			fieldErrors: map[string]int{},
+			checkErr: func(t *testing.T, err error) {
+				var syntaxErr *xml.SyntaxError
+				if !errors.As(err, &syntaxErr) {
+					t.Errorf("error = %v, want a syntax error", err)
+				}
+			},
+		},
+		{
+			name: "missing root",
+			edit: func(s string) string {
+				return `<?xml version="1.0" encoding="UTF-8"?><stats></stats>`
+			},
+			fieldErrors: map[string]int{},
+			checkErr: func(t *testing.T, err error) {
+				var fieldErr *FieldError
+				if !errors.As(err, &fieldErr) || fieldErr.Element != "rtmp" || !errors.Is(err, ErrMissingElement) {
+					t.Errorf("error = %v, want a missing rtmp element", err)
+				}
+			},
+		},
+		{
+			name:        "strict whole document",
+			strict:      true,
+			fieldErrors: map[string]int{},
+			check: func(t *testing.T, stats *Stats) {
+				if names := applicationNames(stats); !reflect.DeepEqual(names, []string{"stream", "hls"}) {
+					t.Errorf("applications = %v, want [stream hls]", names)
+				}
+			},
+		},
+		{
+			name: "strict play section and empty avsync",
+			edit: func(s string) string {
+				return withPlaySection(strings.Replace(s, "<avsync>-118900</avsync>", "<avsync></avsync>", 1))
+			},
+			strict:      true,
+			fieldErrors: map[string]int{},
+			check: func(t *testing.T, stats *Stats) {
+				if play := stats.Servers[0].Applications[0].Play; play == nil || len(play.Streams) != 1 {
+					t.Errorf("play section = %+v, want one stream", play)
+				}
+			},
+		},
+		{
+			name: "strict missing bw_in",
+			edit: func(s string) string {
+				return strings.Replace(s, "<bw_in>1541776</bw_in>", "", 1)
+			},
+			strict:      true,
+			fieldErrors: map[string]int{"stream/bw_in": 1},
+			checkErr: func(t *testing.T, err error) {
+				var fieldErr *FieldError
+				if !errors.As(err, &fieldErr) || fieldErr.Element != "stream/bw_in" || !errors.Is(err, ErrMissingElement) {
+					t.Errorf("error = %v, want a missing stream/bw_in element", err)
+				}
+			},
+		},
+		{
+			name: "strict malformed bw_in",
+			edit: func(s string) string {
+				return strings.Replace(s, "<bw_in>1541776</bw_in>", "<bw_in>fast</bw_in>", 1)
+			},
+			strict:      true,
+			fieldErrors: map[string]int{"stream/bw_in": 1},
+			checkErr: func(t *testing.T, err error) {
+				var fieldErr *FieldError
+				if !errors.As(err, &fieldErr) || fieldErr.Element != "stream/bw_in" || errors.Is(err, ErrMissingElement) {
+					t.Errorf("error = %v, want a malformed stream/bw_in element", err)
+				}
+			},
+		},
+	}
+
+	page := readStats(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := page
+			if test.edit != nil {
+				doc = test.edit(doc)
+			}
+			d := Decoder{Strict: test.strict}
+			stats, err := d.Decode(strings.NewReader(doc))
+			if test.checkErr != nil {
+				if stats != nil {
+					t.Errorf("stats = %+v, want none", stats)
+				}
+				test.checkErr(t, err)
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(d.FieldErrors, test.fieldErrors) {
+				t.Errorf("field errors = %v, want %v", d.FieldErrors, test.fieldErrors)
+			}
+			if test.check != nil && stats != nil {
+				test.check(t, stats)
+			}
+		})
+	}
+}
+
+// benchStats is the document of the benchmarks, generated once
+var benchStats = sync.OnceValue(func() []byte {
+	return generateStats(*benchStreams, *benchClients)
+})
+
+// BenchmarkWalk decodes the stats document as it is read
+func BenchmarkWalk(b *testing.B) {
+	doc := benchStats()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var d Decoder
+		if err := d.Walk(bytes.NewReader(doc), discard{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecode decodes the whole stats document into structs
+func BenchmarkDecode(b *testing.B) {
+	doc := benchStats()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(doc)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDOM builds a DOM of the stats document with xmlquery, as the
+// exporter did before the streaming decoder
+func BenchmarkDOM(b *testing.B) {
+	doc := benchStats()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := decodeDOM(bytes.NewReader(doc)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// decodeDOM reads the same elements as the streaming decoder, the way the
+// exporter did before it
+func decodeDOM(r io.Reader) error {
+	doc, err := xmlquery.Parse(r)
+	if err != nil {
+		return err
+	}
+	root := xmlquery.FindOne(doc, "//rtmp")
+	if root == nil {
+		return fmt.Errorf("missing rtmp element")
+	}
+	for _, stream := range xmlquery.Find(root, "//stream") {
+		for _, name := range []string{"name", "time", "bw_in", "bytes_in", "bw_out", "bytes_out", "bw_audio", "bw_video", "nclients"} {
+			if child := stream.SelectElement(name); child != nil {
+				_ = child.InnerText()
+			}
+		}
+		for _, client := range stream.SelectElements("client") {
+			for _, name := range []string{"id", "address", "time", "dropped", "avsync", "publishing"} {
+				if child := client.SelectElement(name); child != nil {
+					_ = child.InnerText()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// discard ignores the decoded stats
+type discard struct{}
+
+func (discard) Client(Location, Client)           {}
+func (discard) Stream(Location, Stream)           {}
+func (discard) Application(Location, Application) {}
+func (discard) Server(Location, Server)           {}
+func (discard) Stats(Stats)                       {}
+
+// generateStats builds a stats document like the one of tests/stats.xml, with
+// a single application
+func generateStats(streams, clients int) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<rtmp>
+  <nginx_version>1.16.1</nginx_version>
+  <nginx_rtmp_version>1.1.4</nginx_rtmp_version>
+  <uptime>122</uptime>
+  <naccepted>7</naccepted>
+  <bw_in>6937192</bw_in>
+  <bytes_in>93147169</bytes_in>
+  <bw_out>1539632</bw_out>
+  <bytes_out>20761795</bytes_out>
+  <server>
+    <application>
+      <name>live</name>
+      <live>
+`)
+	id := 0
+	for s := 0; s < streams; s++ {
+		fmt.Fprintf(&b, `        <stream>
+          <name>stream_%d</name>
+          <time>118940</time>
+          <bw_in>1541776</bw_in>
+          <bytes_in>20908965</bytes_in>
+          <bw_out>1541776</bw_out>
+          <bytes_out>20726270</bytes_out>
+          <bw_audio>0</bw_audio>
+          <bw_video>1541776</bw_video>
+`, s)
+		for c := 0; c < clients; c++ {
+			id++
+			fmt.Fprintf(&b, `          <client>
+            <id>%d</id>
+            <address>10.0.%d.%d</address>
+            <time>118370</time>
+            <dropped>0</dropped>
+            <avsync>-118900</avsync>
+            <timestamp>118900</timestamp>
+`, id, c/256, c%256)
+			if c == 0 {
+				b.WriteString("            <publishing />\n")
+			}
+			b.WriteString("            <active />\n          </client>\n")
+		}
+		fmt.Fprintf(&b, `          <meta>
+            <video>
+              <width>1280</width>
+              <height>720</height>
+              <frame_rate>30</frame_rate>
+              <codec>H264</codec>
+              <profile>High</profile>
+              <level>3.1</level>
+            </video>
+            <audio />
+          </meta>
+          <nclients>%d</nclients>
+          <publishing />
+          <active />
+        </stream>
+`, clients)
+	}
+	fmt.Fprintf(&b, `        <nclients>%d</nclients>
+      </live>
+    </application>
+  </server>
+</rtmp>
+`, streams*clients)
+	return []byte(b.String())
+}
@@ -0,0 +1,220 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package rtmpstat decodes the stats document served by the rtmp_stat
+// directive of NGINX-RTMP.
+//
+// Numeric fields are NaN when their element is missing or malformed. Times are
+// in seconds and bandwidths in bits per second.
+package rtmpstat
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrMissingElement is the error of a FieldError for a missing element
+var ErrMissingElement = errors.New("missing element")
+
+// FieldError is a missing or malformed element of the stats document
+type FieldError struct {
+	Element string // as "parent/child"
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	return "element " + e.Element + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Stats is the <rtmp> root of the stats document
+type Stats struct {
+	NginxVersion     string
+	NginxRTMPVersion string
+	Compiler         string
+	Built            string
+	PID              float64
+	Uptime           float64
+	Accepted         float64
+	BytesIn          float64
+	BytesOut         float64
+	BandwidthIn      float64
+	BandwidthOut     float64
+	Servers          []Server
+}
+
+// Server is a server{} block of the RTMP configuration
+type Server struct {
+	Applications []Application
+}
+
+// Application is an application{} block of a server
+type Application struct {
+	Name string
+	Live *Section // nil when the application is not live
+	Play *Section // nil when the application doesn't play files
+}
+
+// Section is the <live> or <play> section of an application
+type Section struct {
+	Streams  []Stream
+	NClients float64
+}
+
+// Stream is a stream published or played in an application
+type Stream struct {
+	Name           string
+	Time           float64 // since the stream started
+	BytesIn        float64
+	BytesOut       float64
+	BandwidthIn    float64
+	BandwidthOut   float64
+	BandwidthAudio float64 // not reported by older NGINX-RTMP versions
+	BandwidthVideo float64 // not reported by older NGINX-RTMP versions
+	NClients       float64
+	Publishing     bool
+	Active         bool
+	Meta           Meta
+	Clients        []Client
+}
+
+// Meta is the metadata declared by the publisher of a stream
+type Meta struct {
+	Video *VideoMeta // nil when no video codec was declared
+	Audio *AudioMeta // nil when no audio codec was declared
+}
+
+// VideoMeta is the video metadata of a stream
+type VideoMeta struct {
+	Codec     string
+	Profile   string
+	Level     string
+	Width     float64
+	Height    float64
+	FrameRate float64
+	Compat    float64
+}
+
+// AudioMeta is the audio metadata of a stream
+type AudioMeta struct {
+	Codec      string
+	Profile    string
+	Channels   float64
+	SampleRate float64
+}
+
+// Client is a connection publishing or playing a stream
+type Client struct {
+	ID         string
+	Address    string
+	FlashVer   string
+	SWFURL     string
+	PageURL    string
+	Time       float64 // since the client connected
+	Dropped    float64
+	AVSync     float64
+	Timestamp  float64
+	Publishing bool
+	Active     bool
+}
+
+// Location is where a part of the stats document sits in it
+type Location struct {
+	Server      int    // index of the server block
+	Application string // empty for servers
+	Section     string // live or play, empty for servers and applications
+	Stream      string // empty for servers, applications and streams
+}
+
+// Handler receives the parts of the stats document as soon as they are
+// decoded, without their children. The clients of a stream are handled before
+// the stream, the streams of an application before the application, and so on
+// up to the root of the document, which is handled last.
+type Handler interface {
+	Client(Location, Client)
+	Stream(Location, Stream)
+	Application(Location, Application)
+	Server(Location, Server)
+	Stats(Stats)
+}
+
+// Decode reads a whole stats document from r. Missing or malformed elements
+// are skipped, see Decoder.
+func Decode(r io.Reader) (*Stats, error) {
+	var d Decoder
+	return d.Decode(r)
+}
+
+// Decode reads a whole stats document from r
+func (d *Decoder) Decode(r io.Reader) (*Stats, error) {
+	b := &builder{}
+	if err := d.Walk(r, b); err != nil {
+		return nil, err
+	}
+	return &b.stats, nil
+}
+
+// builder puts the parts of the stats document back together
+type builder struct {
+	stats        Stats
+	servers      []Server
+	applications []Application
+	live, play   []Stream
+	clients      []Client
+}
+
+func (b *builder) Client(_ Location, client Client) {
+	b.clients = append(b.clients, client)
+}
+
+func (b *builder) Stream(loc Location, stream Stream) {
+	stream.Clients, b.clients = b.clients, nil
+	if loc.Section == "play" {
+		b.play = append(b.play, stream)
+	} else {
+		b.live = append(b.live, stream)
+	}
+}
+
+func (b *builder) Application(_ Location, application Application) {
+	if application.Live != nil {
+		application.Live.Streams = b.live
+	}
+	if application.Play != nil {
+		application.Play.Streams = b.play
+	}
+	b.live, b.play = nil, nil
+	b.applications = append(b.applications, application)
+}
+
+func (b *builder) Server(_ Location, server Server) {
+	server.Applications, b.applications = b.applications, nil
+	b.servers = append(b.servers, server)
+}
+
+func (b *builder) Stats(stats Stats) {
+	stats.Servers = b.servers
+	b.stats = stats
+}
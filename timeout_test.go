@@ -0,0 +1,83 @@
+// MIT License
+
+// Copyright (c) 2022 Mauricio Antunes
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScrapeContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		offset  time.Duration
+		timeout time.Duration // 0 for no deadline
+		invalid bool
+	}{
+		{name: "no header", offset: 500 * time.Millisecond},
+		{name: "offset", header: "10", offset: 500 * time.Millisecond, timeout: 9500 * time.Millisecond},
+		{name: "fraction", header: "2.5", offset: time.Second, timeout: 1500 * time.Millisecond},
+		{name: "no offset", header: "10", timeout: 10 * time.Second},
+		{name: "offset longer than timeout", header: "0.3", offset: 500 * time.Millisecond, timeout: 300 * time.Millisecond},
+		{name: "zero", header: "0", invalid: true},
+		{name: "negative", header: "-1", invalid: true},
+		{name: "not a number", header: "ten", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if test.header != "" {
+				req.Header.Set(scrapeTimeoutHeader, test.header)
+			}
+			start := time.Now()
+			ctx, cancel, err := scrapeContext(req, test.offset)
+			if test.invalid {
+				if err == nil {
+					cancel()
+					t.Fatal("invalid header accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if test.timeout == 0 {
+				if ok {
+					t.Errorf("deadline %s, want none", deadline)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no deadline")
+			}
+			if got := deadline.Sub(start); got < test.timeout-50*time.Millisecond || got > test.timeout+50*time.Millisecond {
+				t.Errorf("deadline in %s, want %s", got, test.timeout)
+			}
+		})
+	}
+}